@@ -3,38 +3,62 @@ package application
 import (
 	"fmt"
 
+	"github.com/kawa1214/tcp-ip-go/icmp"
 	"github.com/kawa1214/tcp-ip-go/internet"
 	"github.com/kawa1214/tcp-ip-go/network"
 	"github.com/kawa1214/tcp-ip-go/transport"
 )
 
 type Server struct {
-	network        *network.NetDevice
-	ipPacketQueue  *internet.IpPacketQueue
-	tcpPacketQueue *transport.TcpPacketQueue
+	// IPv4 address of the stack. Packets to other addresses are dropped.
+	Addr [4]byte
+	// TCP port to accept connections on. SYNs to other ports are answered
+	// with an ICMP Port Unreachable message.
+	Port uint16
+
+	network         network.Device
+	ipPacketQueue   *internet.IpPacketQueue
+	icmpPacketQueue *icmp.IcmpPacketQueue
+	tcpPacketQueue  *transport.TcpPacketQueue
 }
 
+// Create a server at 10.0.0.2:80, the address the Makefile routes through
+// tun0.
 func NewServer() *Server {
-	return &Server{}
+	return &Server{
+		Addr: [4]byte{10, 0, 0, 2},
+		Port: 80,
+	}
 }
 
 func (s *Server) ListenAndServe() error {
-	network, err := network.NewTun()
-	network.Bind()
-	s.network = network
+	tun, err := network.NewTun()
 	if err != nil {
 		return err
 	}
-	s.serve()
+	tun.Bind()
+	s.Serve(tun)
 	return nil
 }
 
+// Serve runs the protocol stack on top of the given link device.
+func (s *Server) Serve(device network.Device) {
+	s.network = device
+	s.serve()
+}
+
 func (s *Server) serve() {
 	ipPacketQueue := internet.NewIpPacketQueue()
+	ipPacketQueue.AddAddress(s.Addr)
 	ipPacketQueue.ManageQueues(s.network)
 	s.ipPacketQueue = ipPacketQueue
 
+	icmpPacketQueue := icmp.NewIcmpPacketQueue()
+	icmpPacketQueue.ManageQueues(ipPacketQueue)
+	s.icmpPacketQueue = icmpPacketQueue
+
 	tcpPacketQueue := transport.NewTcpPacketQueue()
+	tcpPacketQueue.Listen(s.Port)
 	tcpPacketQueue.ManageQueues(ipPacketQueue)
 	s.tcpPacketQueue = tcpPacketQueue
 }
@@ -11,10 +11,10 @@ func main() {
 	network, _ := network.NewTun()
 	network.Bind()
 	ip := internet.NewIpPacketQueue()
+	ip.Handle(internet.TCP_PROTOCOL, func(pkt internet.IpPacket) {
+		fmt.Printf("IP Header: %+v\n", pkt.IpHeader)
+	})
 	ip.ManageQueues(network)
 
-	for {
-		pkt, _ := ip.Read()
-		fmt.Printf("IP Header: %+v\n", pkt.IpHeader)
-	}
+	select {}
 }
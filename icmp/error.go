@@ -0,0 +1,58 @@
+package icmp
+
+import (
+	"log"
+	"time"
+
+	"github.com/kawa1214/tcp-ip-go/internet"
+)
+
+// Report whether an error message may be sent about the packet. RFC 1122
+// forbids it for ICMP errors, for fragments other than the first, for
+// packets sent to a broadcast or multicast address and for packets whose
+// source does not identify a single host.
+func mayReplyWithError(pkt internet.IpPacket) bool {
+	hdr := pkt.IpHeader
+	if hdr.FragmentOffset != 0 {
+		return false
+	}
+	if hdr.DstIP == [4]byte{255, 255, 255, 255} || hdr.DstIP[0]>>4 == 0xE {
+		return false
+	}
+	if hdr.SrcIP == [4]byte{} || hdr.SrcIP == [4]byte{255, 255, 255, 255} || hdr.SrcIP[0]>>4 == 0xE {
+		return false
+	}
+	if hdr.Protocol == internet.ICMP_PROTOCOL {
+		payload := pkt.Packet.Buf[int(hdr.IHL)*4 : pkt.Packet.N]
+		if len(payload) == 0 {
+			return false
+		}
+		// Only queries and replies: Echo, Timestamp, Information and
+		// Address Mask.
+		switch payload[0] {
+		case TYPE_ECHO_REPLY, TYPE_ECHO_REQUEST, 13, 14, 15, 16, 17, 18:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Send an error message about pkt back to its sender, unless the rules of
+// mayReplyWithError or the rate limit forbid it. It is installed as the
+// error handler of the IpPacketQueue.
+func (q *IcmpPacketQueue) sendError(pkt internet.IpPacket, typ, code uint8, param uint32) {
+	if !mayReplyWithError(pkt) {
+		return
+	}
+	if !q.limiter.allow(time.Now()) {
+		q.stats.outRateLimited.Add(1)
+		return
+	}
+
+	msg := NewError(typ, code, param, pkt.Packet.Buf[:pkt.Packet.N])
+	err := q.Write(pkt.IpHeader.DstIP, pkt.IpHeader.SrcIP, msg)
+	if err != nil {
+		log.Printf("write error: %s", err.Error())
+	}
+}
@@ -0,0 +1,134 @@
+package icmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/kawa1214/tcp-ip-go/internet"
+)
+
+func TestMayReplyWithError(t *testing.T) {
+	echo := NewEchoRequest(1, 1, []byte("hello")).Marshal()
+	unreachable := NewError(TYPE_DEST_UNREACHABLE, CODE_PORT_UNREACHABLE, 0, []byte{0x45}).Marshal()
+
+	tests := []struct {
+		name     string
+		protocol uint8
+		// Change to the header from NewIp, if any.
+		modify  func(h *internet.Header)
+		payload []byte
+		want    bool
+	}{
+		{name: "tcp segment", protocol: internet.TCP_PROTOCOL, payload: make([]byte, 20), want: true},
+		{
+			name:     "first fragment",
+			protocol: internet.TCP_PROTOCOL,
+			modify:   func(h *internet.Header) { h.Flags = internet.FLAG_MF },
+			payload:  make([]byte, 8),
+			want:     true,
+		},
+		{
+			name:     "later fragment",
+			protocol: internet.TCP_PROTOCOL,
+			modify:   func(h *internet.Header) { h.FragmentOffset = 1 },
+			payload:  make([]byte, 8),
+		},
+		{name: "echo request", protocol: internet.ICMP_PROTOCOL, payload: echo, want: true},
+		{name: "icmp error", protocol: internet.ICMP_PROTOCOL, payload: unreachable},
+		{name: "empty icmp message", protocol: internet.ICMP_PROTOCOL},
+		{
+			name:     "broadcast destination",
+			protocol: internet.TCP_PROTOCOL,
+			modify:   func(h *internet.Header) { h.DstIP = [4]byte{255, 255, 255, 255} },
+			payload:  make([]byte, 20),
+		},
+		{
+			name:     "multicast destination",
+			protocol: internet.TCP_PROTOCOL,
+			modify:   func(h *internet.Header) { h.DstIP = [4]byte{224, 0, 0, 1} },
+			payload:  make([]byte, 20),
+		},
+		{
+			name:     "unspecified source",
+			protocol: internet.TCP_PROTOCOL,
+			modify:   func(h *internet.Header) { h.SrcIP = [4]byte{} },
+			payload:  make([]byte, 20),
+		},
+		{
+			name:     "broadcast source",
+			protocol: internet.TCP_PROTOCOL,
+			modify:   func(h *internet.Header) { h.SrcIP = [4]byte{255, 255, 255, 255} },
+			payload:  make([]byte, 20),
+		},
+		{
+			name:     "multicast source",
+			protocol: internet.TCP_PROTOCOL,
+			modify:   func(h *internet.Header) { h.SrcIP = [4]byte{239, 1, 2, 3} },
+			payload:  make([]byte, 20),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hdr := internet.NewIp(testRemote, testLocal, len(tt.payload))
+			hdr.Protocol = tt.protocol
+			if tt.modify != nil {
+				tt.modify(hdr)
+			}
+			pkt := newTestIpPacket(hdr, tt.payload)
+			defer pkt.Packet.Release()
+
+			if got := mayReplyWithError(pkt); got != tt.want {
+				t.Errorf("mayReplyWithError = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewErrorQuote(t *testing.T) {
+	withOptions := internet.NewIp(testRemote, testLocal, 100)
+	withOptions.Options = []internet.Option{internet.NewRouterAlertOption(0)}
+	withOptions.FixLengths()
+
+	tests := []struct {
+		name    string
+		hdr     *internet.Header
+		payload int
+		want    int
+	}{
+		{name: "long payload", hdr: internet.NewIp(testRemote, testLocal, 100), payload: 100, want: 20 + QUOTE_LEN},
+		{name: "options", hdr: withOptions, payload: 100, want: 24 + QUOTE_LEN},
+		{name: "short payload", hdr: internet.NewIp(testRemote, testLocal, 3), payload: 3, want: 23},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pkt := append(tt.hdr.Marshal(), testPayload(tt.payload)...)
+			msg := NewError(TYPE_PARAMETER_PROBLEM, 0, 21<<24, pkt)
+
+			if len(msg.Data) != tt.want {
+				t.Errorf("quoted %d bytes, want %d", len(msg.Data), tt.want)
+			}
+			if !bytes.Equal(msg.Data, pkt[:len(msg.Data)]) {
+				t.Errorf("quote differs from the start of the packet")
+			}
+			if pointer := binary.BigEndian.Uint32(msg.Rest[:]) >> 24; pointer != 21 {
+				t.Errorf("pointer = %d, want 21", pointer)
+			}
+		})
+	}
+
+	if msg := NewError(TYPE_DEST_UNREACHABLE, CODE_HOST_UNREACHABLE, 0, nil); len(msg.Data) != 0 {
+		t.Errorf("quoted %d bytes of an empty packet", len(msg.Data))
+	}
+}
+
+// Return a payload whose bytes differ from their neighbours.
+func testPayload(n int) []byte {
+	payload := make([]byte, n)
+	for i := range payload {
+		payload[i] = byte(i * 7)
+	}
+	return payload
+}
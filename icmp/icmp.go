@@ -0,0 +1,81 @@
+package icmp
+
+import (
+	"log"
+	"sync/atomic"
+
+	"github.com/kawa1214/tcp-ip-go/internet"
+	"github.com/kawa1214/tcp-ip-go/network"
+)
+
+// IcmpPacketQueue handles the ICMP messages received by an IpPacketQueue.
+// It answers Echo Requests, reports the problems the IP layer finds with
+// error messages and counts every message by type.
+type IcmpPacketQueue struct {
+	ip      *internet.IpPacketQueue
+	id      atomic.Uint32
+	limiter rateLimiter
+	stats   counters
+}
+
+func NewIcmpPacketQueue() *IcmpPacketQueue {
+	return &IcmpPacketQueue{}
+}
+
+// ManageQueues registers the queue as the ICMP handler and the error
+// handler of ip.
+func (q *IcmpPacketQueue) ManageQueues(ip *internet.IpPacketQueue) {
+	q.ip = ip
+	ip.Handle(internet.ICMP_PROTOCOL, q.recv)
+	ip.HandleErrors(q.sendError)
+}
+
+// Stats returns the message counters.
+func (q *IcmpPacketQueue) Stats() Stats {
+	return q.stats.snapshot()
+}
+
+func (q *IcmpPacketQueue) recv(pkt internet.IpPacket) {
+	defer pkt.Packet.Release()
+
+	q.stats.inMsgs.Add(1)
+	msg, err := Unmarshal(pkt.Packet.Buf[int(pkt.IpHeader.IHL)*4 : pkt.Packet.N])
+	if err != nil {
+		q.stats.inErrors.Add(1)
+		log.Printf("unmarshal error: %s", err)
+		return
+	}
+	q.stats.received(msg)
+
+	switch msg.Type {
+	case TYPE_ECHO_REQUEST:
+		// Like Linux, ignore pings to the broadcast address.
+		if pkt.IpHeader.DstIP == [4]byte{255, 255, 255, 255} {
+			return
+		}
+		echo, _ := msg.Echo()
+		err := q.Write(pkt.IpHeader.DstIP, pkt.IpHeader.SrcIP, echo.Message(TYPE_ECHO_REPLY))
+		if err != nil {
+			log.Printf("write error: %s", err.Error())
+		}
+	}
+}
+
+// Write sends the message from src to dst.
+func (q *IcmpPacketQueue) Write(src, dst [4]byte, msg *Message) error {
+	hdr := internet.NewIp(src, dst, msg.Len())
+	hdr.Protocol = internet.ICMP_PROTOCOL
+	hdr.Flags = 0
+	hdr.ID = uint16(q.id.Add(1))
+
+	buf := network.AllocBuffer(msg.Len())
+	msg.MarshalTo(buf.Put(msg.Len()))
+	hdr.MarshalTo(buf.Push(hdr.Len()))
+
+	err := q.ip.Write(buf.Packet())
+	if err != nil {
+		return err
+	}
+	q.stats.sent(msg)
+	return nil
+}
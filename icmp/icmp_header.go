@@ -0,0 +1,178 @@
+package icmp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	LENGTH = 8
+
+	TYPE_ECHO_REPLY        = 0
+	TYPE_DEST_UNREACHABLE  = 3
+	TYPE_ECHO_REQUEST      = 8
+	TYPE_TIME_EXCEEDED     = 11
+	TYPE_PARAMETER_PROBLEM = 12
+
+	// Codes of TYPE_DEST_UNREACHABLE.
+	CODE_NET_UNREACHABLE      = 0
+	CODE_HOST_UNREACHABLE     = 1
+	CODE_PROTOCOL_UNREACHABLE = 2
+	CODE_PORT_UNREACHABLE     = 3
+	CODE_FRAGMENTATION_NEEDED = 4
+
+	// Codes of TYPE_TIME_EXCEEDED. TTL exceeded in transit (code 0) is only
+	// sent by routers, and this stack does not forward packets.
+	CODE_REASSEMBLY_TIME_EXCEEDED = 1
+
+	// Bytes of the offending payload an error message quotes after its
+	// IP header.
+	QUOTE_LEN = 8
+)
+
+// Errors returned for messages that fail validation.
+var (
+	ErrTruncated   = errors.New("truncated ICMP message")
+	ErrBadChecksum = errors.New("invalid ICMP checksum")
+)
+
+// Message is an ICMP message. Rest holds the second word of the header,
+// whose meaning depends on the type, and Data everything after it.
+type Message struct {
+	Type     uint8
+	Code     uint8
+	Checksum uint16
+	Rest     [4]byte
+	Data     []byte
+}
+
+// Unmarshal creates a new ICMP message from packet, the payload of an IP
+// packet. The checksum must be correct.
+func Unmarshal(pkt []byte) (*Message, error) {
+	if len(pkt) < LENGTH {
+		return nil, ErrTruncated
+	}
+	if checksum(pkt) != 0 {
+		return nil, ErrBadChecksum
+	}
+
+	msg := &Message{
+		Type:     pkt[0],
+		Code:     pkt[1],
+		Checksum: binary.BigEndian.Uint16(pkt[2:4]),
+		Data:     make([]byte, len(pkt)-LENGTH),
+	}
+	copy(msg.Rest[:], pkt[4:8])
+	copy(msg.Data, pkt[LENGTH:])
+
+	return msg, nil
+}
+
+// Len returns the length of the marshalled message.
+func (m *Message) Len() int {
+	return LENGTH + len(m.Data)
+}
+
+// Return a byte slice of the message.
+func (m *Message) Marshal() []byte {
+	pkt := make([]byte, m.Len())
+	m.MarshalTo(pkt)
+	return pkt
+}
+
+// Write the message into the first m.Len() bytes of pkt and set its
+// checksum.
+func (m *Message) MarshalTo(pkt []byte) {
+	pkt = pkt[:m.Len()]
+	pkt[0] = m.Type
+	pkt[1] = m.Code
+	binary.BigEndian.PutUint16(pkt[2:4], 0)
+	copy(pkt[4:8], m.Rest[:])
+	copy(pkt[LENGTH:], m.Data)
+
+	m.Checksum = checksum(pkt)
+	binary.BigEndian.PutUint16(pkt[2:4], m.Checksum)
+}
+
+// IsError reports whether the message reports an error, as opposed to a
+// query or a reply.
+func (m *Message) IsError() bool {
+	switch m.Type {
+	case TYPE_DEST_UNREACHABLE, TYPE_TIME_EXCEEDED, TYPE_PARAMETER_PROBLEM:
+		return true
+	}
+	return false
+}
+
+// Echo is the body of an Echo Request or Echo Reply message.
+type Echo struct {
+	ID   uint16
+	Seq  uint16
+	Data []byte
+}
+
+// Echo decodes an Echo Request or Echo Reply message.
+func (m *Message) Echo() (*Echo, error) {
+	if m.Type != TYPE_ECHO_REQUEST && m.Type != TYPE_ECHO_REPLY {
+		return nil, fmt.Errorf("not an echo message")
+	}
+	return &Echo{
+		ID:   binary.BigEndian.Uint16(m.Rest[0:2]),
+		Seq:  binary.BigEndian.Uint16(m.Rest[2:4]),
+		Data: m.Data,
+	}, nil
+}
+
+// Create an Echo Request message.
+func NewEchoRequest(id, seq uint16, data []byte) *Message {
+	echo := &Echo{ID: id, Seq: seq, Data: data}
+	return echo.Message(TYPE_ECHO_REQUEST)
+}
+
+// Message encodes the echo as a message of type typ.
+func (e *Echo) Message(typ uint8) *Message {
+	msg := &Message{Type: typ, Data: e.Data}
+	binary.BigEndian.PutUint16(msg.Rest[0:2], e.ID)
+	binary.BigEndian.PutUint16(msg.Rest[2:4], e.Seq)
+	return msg
+}
+
+// Create an error message of type typ about pkt, an IP packet, quoting its
+// header and the first QUOTE_LEN bytes of its payload. param is the second
+// word of the header, such as the pointer of a Parameter Problem in its top
+// octet.
+func NewError(typ, code uint8, param uint32, pkt []byte) *Message {
+	quoteLen := len(pkt)
+	if len(pkt) > 0 {
+		quoteLen = int(pkt[0]&0x0F)*4 + QUOTE_LEN
+	}
+	if quoteLen > len(pkt) {
+		quoteLen = len(pkt)
+	}
+
+	msg := &Message{Type: typ, Code: code, Data: make([]byte, quoteLen)}
+	binary.BigEndian.PutUint32(msg.Rest[:], param)
+	copy(msg.Data, pkt)
+	return msg
+}
+
+// Return the Internet checksum of buf. It is 0 for a message whose checksum
+// field is correct.
+func checksum(buf []byte) uint16 {
+	length := len(buf)
+	var checksum uint32
+
+	for i := 0; i+1 < length; i += 2 {
+		checksum += uint32(binary.BigEndian.Uint16(buf[i : i+2]))
+	}
+	if length%2 == 1 {
+		checksum += uint32(buf[length-1]) << 8
+	}
+
+	for checksum > 0xffff {
+		checksum = (checksum & 0xffff) + (checksum >> 16)
+	}
+
+	return ^uint16(checksum)
+}
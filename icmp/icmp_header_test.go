@@ -0,0 +1,65 @@
+package icmp
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func TestMarshalChecksum(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  *Message
+		// Change to the marshalled message before Unmarshal, if any.
+		corrupt func(pkt []byte) []byte
+		wantErr error
+	}{
+		{
+			name: "echo request",
+			msg:  NewEchoRequest(1, 2, []byte("ping")),
+		},
+		{
+			name: "odd length",
+			msg:  NewEchoRequest(1, 2, []byte("abc")),
+		},
+		{
+			name: "stale checksum",
+			msg:  &Message{Type: TYPE_DEST_UNREACHABLE, Code: CODE_PORT_UNREACHABLE, Checksum: 0xBEEF, Data: []byte{0x45, 0, 0, 20}},
+		},
+		{
+			name:    "bad checksum",
+			msg:     NewEchoRequest(1, 2, []byte("ping")),
+			corrupt: func(pkt []byte) []byte { pkt[len(pkt)-1] ^= 1; return pkt },
+			wantErr: ErrBadChecksum,
+		},
+		{
+			name:    "truncated",
+			msg:     NewEchoRequest(1, 2, []byte("ping")),
+			corrupt: func(pkt []byte) []byte { return pkt[:LENGTH-1] },
+			wantErr: ErrTruncated,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pkt := tt.msg.Marshal()
+			if checksum(pkt) != 0 {
+				t.Errorf("marshalled message fails the checksum")
+			}
+			if got := binary.BigEndian.Uint16(pkt[2:4]); got != tt.msg.Checksum {
+				t.Errorf("checksum field = %#04x, Checksum = %#04x", got, tt.msg.Checksum)
+			}
+			if tt.corrupt != nil {
+				pkt = tt.corrupt(pkt)
+			}
+
+			got, err := Unmarshal(pkt)
+			if err != tt.wantErr {
+				t.Fatalf("Unmarshal: err = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(got, tt.msg) {
+				t.Errorf("Unmarshal(m.Marshal()) = %+v, want %+v", got, tt.msg)
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package icmp
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/kawa1214/tcp-ip-go/internet"
+	"github.com/kawa1214/tcp-ip-go/network"
+)
+
+var (
+	testLocal  = [4]byte{10, 0, 0, 2}
+	testRemote = [4]byte{10, 0, 0, 1}
+)
+
+// Return a queue that writes to one end of a pipe, and the other end.
+func newTestQueue(t *testing.T) (*IcmpPacketQueue, *network.PipeDevice) {
+	t.Helper()
+	local, peer := network.NewPipe()
+	ip := internet.NewIpPacketQueue()
+	ip.AddAddress(testLocal)
+	ip.ManageQueues(local)
+	t.Cleanup(func() {
+		ip.Close()
+		local.Close()
+	})
+
+	q := NewIcmpPacketQueue()
+	q.ManageQueues(ip)
+	return q, peer
+}
+
+// Return an IP packet from src to dst carrying msg, as handed to recv.
+func newTestPacket(src, dst [4]byte, msg []byte) internet.IpPacket {
+	hdr := internet.NewIp(src, dst, len(msg))
+	hdr.Protocol = internet.ICMP_PROTOCOL
+	return newTestIpPacket(hdr, msg)
+}
+
+// Return a packet with the header followed by the payload.
+func newTestIpPacket(hdr *internet.Header, payload []byte) internet.IpPacket {
+	buf := network.AllocBuffer(len(payload))
+	copy(buf.Put(len(payload)), payload)
+	hdr.MarshalTo(buf.Push(hdr.Len()))
+	return internet.IpPacket{IpHeader: hdr, Packet: buf.Packet()}
+}
+
+func TestEchoReply(t *testing.T) {
+	q, peer := newTestQueue(t)
+	request := NewEchoRequest(0x1234, 7, []byte("hello"))
+	q.recv(newTestPacket(testRemote, testLocal, request.Marshal()))
+
+	pkt, err := peer.Read()
+	if err != nil {
+		t.Fatalf("Read: %s", err)
+	}
+	defer pkt.Release()
+	hdr, err := internet.Unmarshal(pkt.Buf[:pkt.N])
+	if err != nil {
+		t.Fatalf("reply: internet.Unmarshal: %s", err)
+	}
+	if hdr.SrcIP != testLocal || hdr.DstIP != testRemote || hdr.Protocol != internet.ICMP_PROTOCOL {
+		t.Errorf("reply header = %+v, want ICMP from %v to %v", hdr, testLocal, testRemote)
+	}
+	reply, err := Unmarshal(pkt.Buf[hdr.Len():pkt.N])
+	if err != nil {
+		t.Fatalf("reply: Unmarshal: %s", err)
+	}
+	if reply.Type != TYPE_ECHO_REPLY || reply.Code != 0 {
+		t.Errorf("reply type %d code %d, want %d and 0", reply.Type, reply.Code, TYPE_ECHO_REPLY)
+	}
+	echo, err := reply.Echo()
+	if err != nil {
+		t.Fatalf("Echo: %s", err)
+	}
+	if echo.ID != 0x1234 || echo.Seq != 7 || !bytes.Equal(echo.Data, []byte("hello")) {
+		t.Errorf("reply echo = %+v, want the request's ID, sequence and data", echo)
+	}
+}
+
+func TestEchoBroadcast(t *testing.T) {
+	q, _ := newTestQueue(t)
+	request := NewEchoRequest(1, 1, []byte("hello"))
+	q.recv(newTestPacket(testRemote, [4]byte{255, 255, 255, 255}, request.Marshal()))
+
+	if got := q.Stats().OutMsgs; got != 0 {
+		t.Errorf("OutMsgs = %d, want no reply to a broadcast ping", got)
+	}
+}
+
+func TestStats(t *testing.T) {
+	q, peer := newTestQueue(t)
+	badChecksum := NewEchoRequest(1, 1, []byte("hello")).Marshal()
+	badChecksum[2] ^= 1
+	messages := [][]byte{
+		NewEchoRequest(1, 1, []byte("hello")).Marshal(),
+		NewEchoRequest(1, 2, []byte("hello")).Marshal(),
+		(&Echo{ID: 1, Seq: 1, Data: []byte("hello")}).Message(TYPE_ECHO_REPLY).Marshal(),
+		NewError(TYPE_DEST_UNREACHABLE, CODE_PORT_UNREACHABLE, 0, []byte{0x45}).Marshal(),
+		badChecksum,
+		{TYPE_ECHO_REQUEST, 0, 0},
+	}
+	for _, msg := range messages {
+		q.recv(newTestPacket(testRemote, testLocal, msg))
+	}
+
+	want := Stats{
+		InMsgs:   6,
+		InErrors: 2,
+		OutMsgs:  2,
+		InTypes: map[uint8]uint64{
+			TYPE_ECHO_REQUEST:     2,
+			TYPE_ECHO_REPLY:       1,
+			TYPE_DEST_UNREACHABLE: 1,
+		},
+		OutTypes: map[uint8]uint64{TYPE_ECHO_REPLY: 2},
+	}
+	if got := q.Stats(); !reflect.DeepEqual(got, want) {
+		t.Errorf("stats = %+v, want %+v", got, want)
+	}
+	for i := 0; i < 2; i++ {
+		pkt, err := peer.Read()
+		if err != nil {
+			t.Fatalf("Read: %s", err)
+		}
+		pkt.Release()
+	}
+}
@@ -0,0 +1,44 @@
+package icmp
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// Error messages sent per second once the burst is used up. RFC 1812
+	// asks for a limit so floods of bad packets cannot be amplified.
+	ERROR_RATE = 100
+	// Error messages that may be sent back to back.
+	ERROR_BURST = 10
+)
+
+// rateLimiter is a token bucket refilled at ERROR_RATE tokens a second and
+// holding at most ERROR_BURST.
+type rateLimiter struct {
+	tokens float64
+	last   time.Time
+	lock   sync.Mutex
+}
+
+// Take a token if one is left.
+func (r *rateLimiter) allow(now time.Time) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.last.IsZero() {
+		r.tokens = ERROR_BURST
+	} else {
+		r.tokens += now.Sub(r.last).Seconds() * ERROR_RATE
+		if r.tokens > ERROR_BURST {
+			r.tokens = ERROR_BURST
+		}
+	}
+	r.last = now
+
+	if r.tokens < 1 {
+		return false
+	}
+	r.tokens--
+	return true
+}
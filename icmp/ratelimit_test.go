@@ -0,0 +1,46 @@
+package icmp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	var r rateLimiter
+	now := time.Now()
+
+	// Take count tokens at now and report how many were allowed.
+	take := func(now time.Time, count int) int {
+		allowed := 0
+		for i := 0; i < count; i++ {
+			if r.allow(now) {
+				allowed++
+			}
+		}
+		return allowed
+	}
+
+	if got := take(now, ERROR_BURST+5); got != ERROR_BURST {
+		t.Errorf("burst: allowed %d, want %d", got, ERROR_BURST)
+	}
+
+	// Tokens come back at ERROR_RATE a second.
+	now = now.Add(time.Second / ERROR_RATE * 3)
+	if got := take(now, 5); got != 3 {
+		t.Errorf("after 3 tokens' worth of time: allowed %d, want 3", got)
+	}
+	now = now.Add(time.Second / ERROR_RATE / 2)
+	if got := take(now, 1); got != 0 {
+		t.Errorf("after half a token's worth of time: allowed %d, want 0", got)
+	}
+	now = now.Add(time.Second / ERROR_RATE / 2)
+	if got := take(now, 1); got != 1 {
+		t.Errorf("after the other half: allowed %d, want 1", got)
+	}
+
+	// An idle limiter holds no more than a burst.
+	now = now.Add(time.Hour)
+	if got := take(now, ERROR_BURST+5); got != ERROR_BURST {
+		t.Errorf("after an hour: allowed %d, want %d", got, ERROR_BURST)
+	}
+}
@@ -0,0 +1,57 @@
+package icmp
+
+import "sync/atomic"
+
+// Stats holds the counters of an IcmpPacketQueue.
+type Stats struct {
+	// Messages received, including malformed ones.
+	InMsgs uint64
+	// Messages dropped because they were truncated or failed the checksum.
+	InErrors uint64
+	// Messages sent.
+	OutMsgs uint64
+	// Error messages not sent because of the rate limit.
+	OutRateLimited uint64
+	// Messages received and sent, by type. Types never seen are absent.
+	InTypes  map[uint8]uint64
+	OutTypes map[uint8]uint64
+}
+
+// counters is the concurrency-safe backing store of Stats.
+type counters struct {
+	inMsgs         atomic.Uint64
+	inErrors       atomic.Uint64
+	outMsgs        atomic.Uint64
+	outRateLimited atomic.Uint64
+	inTypes        [256]atomic.Uint64
+	outTypes       [256]atomic.Uint64
+}
+
+func (c *counters) received(msg *Message) {
+	c.inTypes[msg.Type].Add(1)
+}
+
+func (c *counters) sent(msg *Message) {
+	c.outMsgs.Add(1)
+	c.outTypes[msg.Type].Add(1)
+}
+
+func (c *counters) snapshot() Stats {
+	stats := Stats{
+		InMsgs:         c.inMsgs.Load(),
+		InErrors:       c.inErrors.Load(),
+		OutMsgs:        c.outMsgs.Load(),
+		OutRateLimited: c.outRateLimited.Load(),
+		InTypes:        make(map[uint8]uint64),
+		OutTypes:       make(map[uint8]uint64),
+	}
+	for i := range c.inTypes {
+		if n := c.inTypes[i].Load(); n > 0 {
+			stats.InTypes[uint8(i)] = n
+		}
+		if n := c.outTypes[i].Load(); n > 0 {
+			stats.OutTypes[uint8(i)] = n
+		}
+	}
+	return stats
+}
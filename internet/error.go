@@ -0,0 +1,36 @@
+package internet
+
+const (
+	icmpTypeDestUnreachable      = 3
+	icmpTypeTimeExceeded         = 11
+	icmpTypeParameterProblem     = 12
+	icmpCodeProtocolUnreachable  = 2
+	icmpCodeReassemblyTimeExceed = 1
+)
+
+// ErrorHandler reports a problem with a received packet to its sender. typ
+// and code are the ICMP type and code, and param the second word of the
+// ICMP header, such as the pointer of a Parameter Problem in its top octet.
+// The packet must not be kept after the handler returns.
+type ErrorHandler func(pkt IpPacket, typ, code uint8, param uint32)
+
+// HandleErrors registers the handler that reports problems with received
+// packets, usually an icmp.IcmpPacketQueue. Without one, problems are not
+// reported.
+func (q *IpPacketQueue) HandleErrors(handler ErrorHandler) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.errorHandler = handler
+}
+
+// SendError reports a problem with a received packet to its sender, for
+// example a segment for a port nobody listens on.
+func (q *IpPacketQueue) SendError(pkt IpPacket, typ, code uint8, param uint32) {
+	q.lock.Lock()
+	handler := q.errorHandler
+	q.lock.Unlock()
+
+	if handler != nil {
+		handler(pkt, typ, code, param)
+	}
+}
@@ -0,0 +1,71 @@
+package internet
+
+import (
+	"fmt"
+
+	"github.com/kawa1214/tcp-ip-go/network"
+)
+
+const (
+	// Smallest MTU every IPv4 link must support.
+	MIN_MTU = 68
+)
+
+// FragmentationNeededError is returned when a packet is larger than the MTU
+// but its Don't Fragment flag forbids splitting it.
+type FragmentationNeededError struct {
+	MTU int
+}
+
+func (e *FragmentationNeededError) Error() string {
+	return fmt.Sprintf("fragmentation needed: packet exceeds MTU %d and DF is set", e.MTU)
+}
+
+// Split the packet into fragments of at most mtu bytes. The first fragment
+// carries every option, the others only those with the copied flag set.
+func fragmentPacket(hdr *Header, pkt network.Packet, mtu int) ([]network.Packet, error) {
+	if hdr.Flags&FLAG_DF != 0 {
+		return nil, &FragmentationNeededError{MTU: mtu}
+	}
+	if mtu < MIN_MTU {
+		return nil, fmt.Errorf("invalid MTU: %d", mtu)
+	}
+
+	payload := pkt.Buf[int(hdr.IHL)*4 : hdr.TotalLength]
+	base := int(hdr.FragmentOffset) * 8
+
+	var copied []Option
+	for _, opt := range hdr.Options {
+		if opt.Type&0x80 != 0 {
+			copied = append(copied, opt)
+		}
+	}
+
+	fragments := make([]network.Packet, 0, len(payload)/(mtu-IP_HEADER_MIN_LEN)+1)
+	for offset := 0; offset < len(payload); {
+		fragHdr := *hdr
+		if offset > 0 {
+			fragHdr.Options = copied
+		}
+		hdrLen := fragHdr.Len()
+
+		size := len(payload) - offset
+		if hdrLen+size > mtu {
+			size = (mtu - hdrLen) &^ 7
+			fragHdr.Flags |= FLAG_MF
+		}
+		fragHdr.IHL = uint8(hdrLen / 4)
+		fragHdr.TotalLength = uint16(hdrLen + size)
+		fragHdr.FragmentOffset = uint16((base + offset) / 8)
+
+		buf := network.AllocBuffer(size)
+		copy(buf.Put(size), payload[offset:offset+size])
+		fragHdr.MarshalTo(buf.Push(hdrLen))
+
+		frag := buf.Packet()
+		frag.Protocol = pkt.Protocol
+		fragments = append(fragments, frag)
+		offset += size
+	}
+	return fragments, nil
+}
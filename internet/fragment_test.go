@@ -0,0 +1,116 @@
+package internet
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/kawa1214/tcp-ip-go/network"
+)
+
+// Return a packet with the header followed by the payload.
+func newTestPacket(hdr *Header, payload []byte) network.Packet {
+	buf := network.AllocBuffer(len(payload))
+	copy(buf.Put(len(payload)), payload)
+	hdr.MarshalTo(buf.Push(hdr.Len()))
+	return buf.Packet()
+}
+
+// Return a payload whose bytes differ from their neighbours.
+func testPayload(n int) []byte {
+	payload := make([]byte, n)
+	for i := range payload {
+		payload[i] = byte(i * 7)
+	}
+	return payload
+}
+
+func TestFragment(t *testing.T) {
+	src := [4]byte{10, 0, 0, 1}
+	dst := [4]byte{10, 0, 0, 2}
+	copied := NewSourceRouteOption(false, [][4]byte{{192, 168, 0, 1}})
+	notCopied := NewRecordRouteOption(2)
+
+	tests := []struct {
+		name    string
+		mtu     int
+		size    int
+		options []Option
+	}{
+		{name: "minimum mtu", mtu: MIN_MTU, size: 1000},
+		{name: "odd mtu", mtu: 1001, size: 3000},
+		{name: "ethernet mtu", mtu: 1500, size: 4000},
+		{name: "payload fits exactly", mtu: 1500, size: 2 * 1480},
+		{name: "options", mtu: 576, size: 2000, options: []Option{notCopied, copied}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := testPayload(tt.size)
+			hdr := NewIp(src, dst, len(payload))
+			hdr.Flags = 0
+			hdr.ID = 42
+			hdr.Options = tt.options
+			hdr.FixLengths()
+			pkt := newTestPacket(hdr, payload)
+
+			fragments, err := fragmentPacket(hdr, pkt, tt.mtu)
+			if err != nil {
+				t.Fatalf("fragmentPacket: %s", err)
+			}
+
+			var reassembled []byte
+			for i, frag := range fragments {
+				last := i == len(fragments)-1
+				if int(frag.N) > tt.mtu {
+					t.Errorf("fragment %d: %d bytes, more than the MTU %d", i, frag.N, tt.mtu)
+				}
+				fragHdr, err := Unmarshal(frag.Buf[:frag.N])
+				if err != nil {
+					t.Fatalf("fragment %d: Unmarshal: %s", i, err)
+				}
+				data := frag.Buf[fragHdr.Len():frag.N]
+				if !last && len(data)%8 != 0 {
+					t.Errorf("fragment %d: payload of %d bytes is not a multiple of 8", i, len(data))
+				}
+				if int(fragHdr.FragmentOffset)*8 != len(reassembled) {
+					t.Errorf("fragment %d: offset %d, want %d", i, int(fragHdr.FragmentOffset)*8, len(reassembled))
+				}
+				if more := fragHdr.Flags&FLAG_MF != 0; more == last {
+					t.Errorf("fragment %d: MF = %t on fragment %d of %d", i, more, i+1, len(fragments))
+				}
+				if fragHdr.ID != hdr.ID {
+					t.Errorf("fragment %d: ID = %d, want %d", i, fragHdr.ID, hdr.ID)
+				}
+
+				wantOptions := tt.options
+				if i > 0 && len(tt.options) > 0 {
+					wantOptions = []Option{copied}
+				}
+				if !reflect.DeepEqual(fragHdr.Options, wantOptions) {
+					t.Errorf("fragment %d: options = %v, want %v", i, fragHdr.Options, wantOptions)
+				}
+				reassembled = append(reassembled, data...)
+			}
+			if !bytes.Equal(reassembled, payload) {
+				t.Errorf("fragments do not add up to the payload")
+			}
+		})
+	}
+}
+
+func TestFragmentDontFragment(t *testing.T) {
+	payload := testPayload(2000)
+	hdr := NewIp([4]byte{10, 0, 0, 1}, [4]byte{10, 0, 0, 2}, len(payload))
+	pkt := newTestPacket(hdr, payload)
+
+	_, err := fragmentPacket(hdr, pkt, 1500)
+	var fragErr *FragmentationNeededError
+	if !errors.As(err, &fragErr) {
+		t.Fatalf("fragmentPacket with DF set: err = %v, want *FragmentationNeededError", err)
+	}
+	if fragErr.MTU != 1500 {
+		t.Errorf("MTU = %d, want 1500", fragErr.MTU)
+	}
+}
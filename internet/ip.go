@@ -2,8 +2,11 @@ package internet
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"sync"
+	"time"
 
 	"github.com/kawa1214/tcp-ip-go/network"
 )
@@ -17,22 +20,101 @@ type IpPacket struct {
 	Packet   network.Packet
 }
 
+// ProtocolHandler receives the packets of a registered protocol. It is
+// called from the reader goroutine, so it should hand slow work off. The
+// handler owns the packet and releases it once consumed.
+type ProtocolHandler func(pkt IpPacket)
+
 type IpPacketQueue struct {
-	incomingQueue chan IpPacket
 	outgoingQueue chan network.Packet
+	addresses     map[[4]byte]struct{}
+	handlers      map[uint8]ProtocolHandler
+	errorHandler  ErrorHandler
+	reassembler   *reassembler
+	mtu           int
+	gsoMaxSize    int
+	stats         counters
+	lock          sync.Mutex
 	ctx           context.Context
 	cancel        context.CancelFunc
 }
 
 func NewIpPacketQueue() *IpPacketQueue {
-	return &IpPacketQueue{
-		incomingQueue: make(chan IpPacket, QUEUE_SIZE),
+	q := &IpPacketQueue{
 		outgoingQueue: make(chan network.Packet, QUEUE_SIZE),
+		addresses:     make(map[[4]byte]struct{}),
+		handlers:      make(map[uint8]ProtocolHandler),
+		mtu:           network.MTU,
+		gsoMaxSize:    network.MTU,
+	}
+	q.reassembler = newReassembler(&q.stats)
+	return q
+}
+
+// AddAddress adds an address of the host. Once one is added, packets to
+// other destinations than these addresses and the limited broadcast address
+// are dropped. Until then every packet is accepted.
+func (q *IpPacketQueue) AddAddress(addr [4]byte) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.addresses[addr] = struct{}{}
+}
+
+// Handle registers the handler for an upper-layer protocol number, such as
+// TCP_PROTOCOL. Packets of protocols without a handler are reported to the
+// error handler as Protocol Unreachable.
+func (q *IpPacketQueue) Handle(protocol uint8, handler ProtocolHandler) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.handlers[protocol] = handler
+}
+
+func (q *IpPacketQueue) handler(protocol uint8) (ProtocolHandler, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	handler, ok := q.handlers[protocol]
+	return handler, ok
+}
+
+// Report whether dst is one of our addresses.
+func (q *IpPacketQueue) isLocal(dst [4]byte) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if len(q.addresses) == 0 || dst == [4]byte{255, 255, 255, 255} {
+		return true
 	}
+	_, ok := q.addresses[dst]
+	return ok
+}
+
+// Stats returns the receive counters.
+func (q *IpPacketQueue) Stats() Stats {
+	return q.stats.snapshot()
 }
 
-func (ip *IpPacketQueue) ManageQueues(network *network.NetDevice) {
+// MTU returns the MTU of the device, or network.MTU before ManageQueues is
+// called.
+func (q *IpPacketQueue) MTU() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.mtu
+}
+
+// GSOMaxSize returns the largest TCP packet the device accepts, which is
+// larger than the MTU when the device segments TCP packets itself, or
+// network.MTU before ManageQueues is called.
+func (q *IpPacketQueue) GSOMaxSize() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.gsoMaxSize
+}
+
+func (ip *IpPacketQueue) ManageQueues(device network.Device) {
 	ip.ctx, ip.cancel = context.WithCancel(context.Background())
+	ip.lock.Lock()
+	ip.mtu = device.MTU()
+	ip.gsoMaxSize = network.GSOMaxSize(device)
+	ip.lock.Unlock()
 
 	go func() {
 		for {
@@ -40,20 +122,78 @@ func (ip *IpPacketQueue) ManageQueues(network *network.NetDevice) {
 			case <-ip.ctx.Done():
 				return
 			default:
-				pkt, err := network.Read()
+				pkt, err := device.Read()
 				if err != nil {
 					log.Printf("read error: %s", err.Error())
+					return
+				}
+				ip.stats.inReceives.Add(1)
+				if pkt.Protocol != 0 && pkt.Protocol != network.ETHER_TYPE_IPV4 {
+					ip.stats.inNotIPv4.Add(1)
+					pkt.Release()
+					continue
 				}
-				ipHeader, err := unmarshal(pkt.Buf[:pkt.N])
+				ipHeader, err := Unmarshal(pkt.Buf[:pkt.N])
 				if err != nil {
+					ip.stats.invalid(err)
 					log.Printf("unmarshal error: %s", err)
+					var optErr *OptionError
+					if errors.As(err, &optErr) && ip.isLocal(optErr.Header.DstIP) {
+						ipPacket := IpPacket{IpHeader: optErr.Header, Packet: pkt}
+						ip.SendError(ipPacket, icmpTypeParameterProblem, 0, uint32(optErr.Pointer)<<24)
+					}
+					pkt.Release()
 					continue
 				}
+				if int(pkt.N) < int(ipHeader.TotalLength) {
+					ip.stats.invalid(ErrTruncated)
+					pkt.Release()
+					continue
+				}
+				if !ip.isLocal(ipHeader.DstIP) {
+					ip.stats.inAddrErrors.Add(1)
+					pkt.Release()
+					continue
+				}
+				pkt = pkt.Truncate(uintptr(ipHeader.TotalLength))
+				if ipHeader.Flags&FLAG_MF != 0 || ipHeader.FragmentOffset != 0 {
+					fragment := pkt
+					var ok bool
+					ipHeader, pkt, ok = ip.reassembler.add(ipHeader, fragment, time.Now())
+					fragment.Release()
+					if !ok {
+						continue
+					}
+				}
 				ipPacket := IpPacket{
 					IpHeader: ipHeader,
 					Packet:   pkt,
 				}
-				ip.incomingQueue <- ipPacket
+				handler, ok := ip.handler(ipHeader.Protocol)
+				if !ok {
+					ip.stats.inUnknownProtos.Add(1)
+					ip.SendError(ipPacket, icmpTypeDestUnreachable, icmpCodeProtocolUnreachable, 0)
+					pkt.Release()
+					continue
+				}
+				ip.stats.inDelivers.Add(1)
+				handler(ipPacket)
+			}
+		}
+	}()
+
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ip.ctx.Done():
+				return
+			case now := <-ticker.C:
+				for _, head := range ip.reassembler.expire(now) {
+					ip.SendError(head, icmpTypeTimeExceeded, icmpCodeReassemblyTimeExceed, 0)
+					head.Packet.Release()
+				}
 			}
 		}
 	}()
@@ -64,7 +204,7 @@ func (ip *IpPacketQueue) ManageQueues(network *network.NetDevice) {
 			case <-ip.ctx.Done():
 				return
 			case pkt := <-ip.outgoingQueue:
-				err := network.Write(pkt)
+				err := device.Write(pkt)
 				if err != nil {
 					log.Printf("write error: %s", err.Error())
 				}
@@ -77,19 +217,56 @@ func (q *IpPacketQueue) Close() {
 	q.cancel()
 }
 
-func (q *IpPacketQueue) Read() (IpPacket, error) {
-	pkt, ok := <-q.incomingQueue
-	if !ok {
-		return IpPacket{}, fmt.Errorf("incoming queue is closed")
+// Write queues the packet for sending. Packets larger than the MTU are
+// fragmented, unless their Don't Fragment flag is set, in which case a
+// *FragmentationNeededError is returned. TCP packets may be as large as
+// GSOMaxSize, since the device segments them. Like network.Device.Write,
+// Write takes the packet over even when it returns an error.
+func (q *IpPacketQueue) Write(pkt network.Packet) error {
+	mtu := q.MTU()
+	if int(pkt.N) <= mtu {
+		return q.enqueue(pkt)
+	}
+	if pkt.N >= IP_HEADER_MIN_LEN && pkt.Buf[9] == TCP_PROTOCOL && int(pkt.N) <= q.GSOMaxSize() {
+		return q.enqueue(pkt)
+	}
+
+	hdr, err := Unmarshal(pkt.Buf[:pkt.N])
+	if err == nil && int(pkt.N) < int(hdr.TotalLength) {
+		err = ErrTruncated
+	}
+	if err != nil {
+		pkt.Release()
+		q.stats.fragFails.Add(1)
+		return err
+	}
+	fragments, err := fragmentPacket(hdr, pkt, mtu)
+	pkt.Release()
+	if err != nil {
+		q.stats.fragFails.Add(1)
+		return err
 	}
-	return pkt, nil
+
+	q.stats.fragOKs.Add(1)
+	q.stats.fragCreates.Add(uint64(len(fragments)))
+	for i, frag := range fragments {
+		err := q.enqueue(frag)
+		if err != nil {
+			for _, rest := range fragments[i+1:] {
+				rest.Release()
+			}
+			return err
+		}
+	}
+	return nil
 }
 
-func (q *IpPacketQueue) Write(pkt network.Packet) error {
+func (q *IpPacketQueue) enqueue(pkt network.Packet) error {
 	select {
 	case q.outgoingQueue <- pkt:
 		return nil
 	case <-q.ctx.Done():
+		pkt.Release()
 		return fmt.Errorf("network closed")
 	}
 }
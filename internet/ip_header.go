@@ -2,6 +2,7 @@ package internet
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 )
 
@@ -18,6 +19,7 @@ type Header struct {
 	Checksum       uint16
 	SrcIP          [4]byte
 	DstIP          [4]byte
+	Options        []Option
 }
 
 const (
@@ -26,14 +28,52 @@ const (
 	TOS               = 0
 	TTL               = 64
 	LENGTH            = IHL * 4
+	ICMP_PROTOCOL     = 1
 	TCP_PROTOCOL      = 6
+	UDP_PROTOCOL      = 17
 	IP_HEADER_MIN_LEN = 20
+	IP_HEADER_MAX_LEN = 60
+
+	// Bits of Header.Flags.
+	FLAG_MF = 0x1
+	FLAG_DF = 0x2
+)
+
+// Errors returned for packets that fail validation.
+var (
+	ErrTruncated       = errors.New("truncated IP packet")
+	ErrBadVersion      = errors.New("invalid IP version")
+	ErrBadHeaderLength = errors.New("invalid IP header length")
+	ErrBadTotalLength  = errors.New("invalid IP total length")
+	ErrBadChecksum     = errors.New("invalid IP header checksum")
+	ErrBadOption       = errors.New("invalid IP option")
 )
 
-// New creates a new IP header from packet.
-func unmarshal(pkt []byte) (*Header, error) {
+// Unmarshal creates a new IP header from the start of packet. The header
+// must be a valid IPv4 header, but only the header is parsed: pkt may hold
+// fewer or more than TotalLength bytes, so receivers check TotalLength
+// against the packet themselves. Unmarshal(h.Marshal()) returns a header
+// equal to h. A malformed option is reported as an *OptionError.
+func Unmarshal(pkt []byte) (*Header, error) {
 	if len(pkt) < IP_HEADER_MIN_LEN {
-		return nil, fmt.Errorf("invalid IP header length")
+		return nil, ErrTruncated
+	}
+	if pkt[0]>>4 != IP_VERSION {
+		return nil, ErrBadVersion
+	}
+	hdrLen := int(pkt[0]&0x0F) * 4
+	if hdrLen < IP_HEADER_MIN_LEN {
+		return nil, ErrBadHeaderLength
+	}
+	if len(pkt) < hdrLen {
+		return nil, ErrTruncated
+	}
+	totalLen := int(binary.BigEndian.Uint16(pkt[2:4]))
+	if totalLen < hdrLen {
+		return nil, ErrBadTotalLength
+	}
+	if checksum(pkt[:hdrLen]) != 0 {
+		return nil, ErrBadChecksum
 	}
 
 	header := &Header{
@@ -52,10 +92,20 @@ func unmarshal(pkt []byte) (*Header, error) {
 	copy(header.SrcIP[:], pkt[12:16])
 	copy(header.DstIP[:], pkt[16:20])
 
+	options, err := unmarshalOptions(pkt[IP_HEADER_MIN_LEN:hdrLen])
+	if err != nil {
+		if optErr, ok := err.(*OptionError); ok {
+			optErr.Header = header
+		}
+		return nil, err
+	}
+	header.Options = options
+
 	return header, nil
 }
 
-// Create a new IP header.
+// Create a new IP header for a TCP segment of len bytes, with the Don't
+// Fragment flag set.
 func NewIp(srcIP, dstIP [4]byte, len int) *Header {
 	return &Header{
 		Version:     IP_VERSION,
@@ -63,7 +113,7 @@ func NewIp(srcIP, dstIP [4]byte, len int) *Header {
 		TOS:         TOS,
 		TotalLength: uint16(LENGTH + len),
 		ID:          0,
-		Flags:       0x40,
+		Flags:       FLAG_DF,
 		TTL:         64,
 		Protocol:    TCP_PROTOCOL,
 		Checksum:    0,
@@ -72,41 +122,92 @@ func NewIp(srcIP, dstIP [4]byte, len int) *Header {
 	}
 }
 
-// Return a byte slice of the packet.
+// Len returns the length of the marshalled header: 20 bytes plus the
+// options padded to a multiple of 4 bytes.
+func (h *Header) Len() int {
+	length := IP_HEADER_MIN_LEN
+	for _, opt := range h.Options {
+		length += opt.len()
+	}
+	return (length + 3) &^ 3
+}
+
+// FixLengths sets IHL from the options and adjusts TotalLength so the
+// payload length it implies is unchanged. Call it after changing Options.
+func (h *Header) FixLengths() {
+	hdrLen := h.Len()
+	h.TotalLength = uint16(int(h.TotalLength) - int(h.IHL)*4 + hdrLen)
+	h.IHL = uint8(hdrLen / 4)
+}
+
+// Return a byte slice of the header. It panics if the options do not fit in
+// IP_OPTIONS_MAX_LEN bytes.
 func (h *Header) Marshal() []byte {
+	pkt := make([]byte, h.Len())
+	h.MarshalTo(pkt)
+	return pkt
+}
+
+// Write the header into the first h.Len() bytes of pkt, for example the
+// headroom of a network.Buffer. IHL and TotalLength are written as they are;
+// see FixLengths. Checksum is set to the computed checksum. It panics if the
+// options do not fit in IP_OPTIONS_MAX_LEN bytes, since IHL could not
+// describe the header.
+func (h *Header) MarshalTo(pkt []byte) {
+	hdrLen := h.Len()
+	if hdrLen > IP_HEADER_MAX_LEN {
+		panic(fmt.Sprintf("internet: IP options take %d bytes, more than %d", hdrLen-IP_HEADER_MIN_LEN, IP_OPTIONS_MAX_LEN))
+	}
+
 	versionAndIHL := (h.Version << 4) | h.IHL
-	flagsAndFragmentOffset := (uint16(h.FragmentOffset) << 13) | (h.FragmentOffset & 0x1FFF)
+	flagsAndFragmentOffset := (uint16(h.Flags&0x7) << 13) | (h.FragmentOffset & 0x1FFF)
 
-	pkt := make([]byte, 20)
+	pkt = pkt[:hdrLen]
 	pkt[0] = versionAndIHL
-	pkt[1] = 0
+	pkt[1] = h.TOS
 	binary.BigEndian.PutUint16(pkt[2:4], h.TotalLength)
 	binary.BigEndian.PutUint16(pkt[4:6], h.ID)
 	binary.BigEndian.PutUint16(pkt[6:8], flagsAndFragmentOffset)
 	pkt[8] = h.TTL
 	pkt[9] = h.Protocol
-	binary.BigEndian.PutUint16(pkt[10:12], h.Checksum)
+	binary.BigEndian.PutUint16(pkt[10:12], 0)
 	copy(pkt[12:16], h.SrcIP[:])
 	copy(pkt[16:20], h.DstIP[:])
 
+	offset := IP_HEADER_MIN_LEN
+	for _, opt := range h.Options {
+		opt.marshalTo(pkt[offset:])
+		offset += opt.len()
+	}
+	for ; offset < hdrLen; offset++ {
+		pkt[offset] = IP_OPTION_END
+	}
+
 	h.setChecksum(pkt)
 	binary.BigEndian.PutUint16(pkt[10:12], h.Checksum)
-
-	return pkt
 }
 
 // Calculates the checksum of the packet and sets Header.
 func (h *Header) setChecksum(pkt []byte) {
-	length := len(pkt)
+	h.Checksum = checksum(pkt)
+}
+
+// Return the Internet checksum of buf. It is 0 for a header whose checksum
+// field is correct.
+func checksum(buf []byte) uint16 {
+	length := len(buf)
 	var checksum uint32
 
-	for i := 0; i < length; i += 2 {
-		checksum += uint32(binary.BigEndian.Uint16(pkt[i : i+2]))
+	for i := 0; i+1 < length; i += 2 {
+		checksum += uint32(binary.BigEndian.Uint16(buf[i : i+2]))
+	}
+	if length%2 == 1 {
+		checksum += uint32(buf[length-1]) << 8
 	}
 
 	for checksum > 0xffff {
 		checksum = (checksum & 0xffff) + (checksum >> 16)
 	}
 
-	h.Checksum = ^uint16(checksum)
+	return ^uint16(checksum)
 }
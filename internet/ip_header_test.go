@@ -0,0 +1,107 @@
+package internet
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMarshalRoundTrip(t *testing.T) {
+	src := [4]byte{10, 0, 0, 1}
+	dst := [4]byte{10, 0, 0, 2}
+
+	tests := []struct {
+		name   string
+		header func() *Header
+	}{
+		{
+			name:   "plain",
+			header: func() *Header { return NewIp(src, dst, 100) },
+		},
+		{
+			name: "fragment",
+			header: func() *Header {
+				h := NewIp(src, dst, 100)
+				h.Flags = FLAG_MF
+				h.FragmentOffset = 185
+				h.ID = 0xBEEF
+				return h
+			},
+		},
+		{
+			name: "tos and ttl",
+			header: func() *Header {
+				h := NewIp(src, dst, 0)
+				h.TOS = 0xB8
+				h.TTL = 1
+				h.Protocol = UDP_PROTOCOL
+				return h
+			},
+		},
+		{
+			name: "record route",
+			header: func() *Header {
+				h := NewIp(src, dst, 8)
+				h.Options = []Option{NewRecordRouteOption(IP_ROUTE_MAX_SLOTS)}
+				h.FixLengths()
+				return h
+			},
+		},
+		{
+			name: "padded options",
+			header: func() *Header {
+				h := NewIp(src, dst, 8)
+				h.Options = []Option{
+					{Type: IP_OPTION_NOP},
+					NewRouterAlertOption(0),
+					NewSourceRouteOption(true, [][4]byte{{192, 168, 0, 1}}),
+				}
+				h.FixLengths()
+				return h
+			},
+		},
+		{
+			name: "timestamp",
+			header: func() *Header {
+				h := NewIp(src, dst, 8)
+				h.Options = []Option{NewTimestampOption(IP_TIMESTAMP_AND_ADDRESS, 4)}
+				h.FixLengths()
+				return h
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := tt.header()
+			got, err := Unmarshal(h.Marshal())
+			if err != nil {
+				t.Fatalf("Unmarshal: %s", err)
+			}
+			if !reflect.DeepEqual(got, h) {
+				t.Errorf("Unmarshal(h.Marshal()) = %+v, want %+v", got, h)
+			}
+		})
+	}
+}
+
+func TestMarshalKeepsLengths(t *testing.T) {
+	h := NewIp([4]byte{10, 0, 0, 1}, [4]byte{10, 0, 0, 2}, 4)
+	h.IHL = 4
+	h.Options = []Option{NewRouterAlertOption(0)}
+	pkt := h.Marshal()
+
+	if ihl := pkt[0] & 0x0F; ihl != 4 {
+		t.Errorf("IHL = %d, want 4", ihl)
+	}
+	if totalLen := int(pkt[2])<<8 | int(pkt[3]); totalLen != 24 {
+		t.Errorf("TotalLength = %d, want 24", totalLen)
+	}
+	if h.IHL != 4 || h.TotalLength != 24 {
+		t.Errorf("Marshal changed IHL to %d and TotalLength to %d", h.IHL, h.TotalLength)
+	}
+
+	h.FixLengths()
+	if h.IHL != 6 || h.TotalLength != 32 {
+		t.Errorf("after FixLengths IHL = %d, TotalLength = %d, want 6 and 32", h.IHL, h.TotalLength)
+	}
+}
@@ -0,0 +1,288 @@
+package internet
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	IP_OPTION_END          = 0
+	IP_OPTION_NOP          = 1
+	IP_OPTION_RECORD_ROUTE = 7
+	IP_OPTION_TIMESTAMP    = 68
+	IP_OPTION_LSRR         = 131
+	IP_OPTION_SSRR         = 137
+	IP_OPTION_ROUTER_ALERT = 148
+
+	// Timestamp option flags.
+	IP_TIMESTAMP_ONLY         = 0
+	IP_TIMESTAMP_AND_ADDRESS  = 1
+	IP_TIMESTAMP_PRESPECIFIED = 3
+
+	// Room for options in the header.
+	IP_OPTIONS_MAX_LEN = IP_HEADER_MAX_LEN - IP_HEADER_MIN_LEN
+	// Most addresses a route option fits in IP_OPTIONS_MAX_LEN bytes.
+	IP_ROUTE_MAX_SLOTS = (IP_OPTIONS_MAX_LEN - 3) / 4
+)
+
+// Option is an IPv4 option. Data holds the bytes after the type and length
+// octets, and is empty for the single-octet NOP option.
+type Option struct {
+	Type uint8
+	Data []byte
+}
+
+// OptionError is returned by Unmarshal for a malformed option. Pointer is
+// the offset in the header of the octet at fault, as reported in an ICMP
+// Parameter Problem message, and Header the header without its options, so
+// the sender can be told about it. It matches ErrBadOption with errors.Is.
+type OptionError struct {
+	Pointer int
+	Header  *Header
+}
+
+func (e *OptionError) Error() string {
+	return fmt.Sprintf("%s at offset %d", ErrBadOption, e.Pointer)
+}
+
+func (e *OptionError) Is(target error) bool {
+	return target == ErrBadOption
+}
+
+// Return the options in buf, the header bytes after the fixed 20. Parsing
+// stops at the End of Option List option; what follows it is padding.
+func unmarshalOptions(buf []byte) ([]Option, error) {
+	var opts []Option
+	offset := IP_HEADER_MIN_LEN
+	for len(buf) > 0 {
+		typ := buf[0]
+		if typ == IP_OPTION_END {
+			break
+		}
+		if typ == IP_OPTION_NOP {
+			opts = append(opts, Option{Type: typ})
+			buf = buf[1:]
+			offset++
+			continue
+		}
+		if len(buf) < 2 || buf[1] < 2 || int(buf[1]) > len(buf) {
+			return nil, &OptionError{Pointer: offset + 1}
+		}
+		length := int(buf[1])
+		opt := Option{Type: typ}
+		if length > 2 {
+			opt.Data = make([]byte, length-2)
+			copy(opt.Data, buf[2:length])
+		}
+		if err := opt.validate(); err != nil {
+			return nil, &OptionError{Pointer: offset}
+		}
+		opts = append(opts, opt)
+		buf = buf[length:]
+		offset += length
+	}
+	return opts, nil
+}
+
+// Check the length and pointer of the options we know.
+func (o Option) validate() error {
+	switch o.Type {
+	case IP_OPTION_RECORD_ROUTE, IP_OPTION_LSRR, IP_OPTION_SSRR:
+		_, err := o.Route()
+		return err
+	case IP_OPTION_TIMESTAMP:
+		_, err := o.Timestamp()
+		return err
+	case IP_OPTION_ROUTER_ALERT:
+		_, err := o.RouterAlert()
+		return err
+	}
+	return nil
+}
+
+// Return the number of bytes the option takes in the header.
+func (o Option) len() int {
+	if o.Type == IP_OPTION_END || o.Type == IP_OPTION_NOP {
+		return 1
+	}
+	return 2 + len(o.Data)
+}
+
+// Write the option into the first o.len() bytes of buf.
+func (o Option) marshalTo(buf []byte) {
+	buf[0] = o.Type
+	if o.Type == IP_OPTION_END || o.Type == IP_OPTION_NOP {
+		return
+	}
+	buf[1] = uint8(2 + len(o.Data))
+	copy(buf[2:], o.Data)
+}
+
+// RouteOption is the body of the Record Route, Loose Source Route and Strict
+// Source Route options. Pointer is the one-based offset, from the start of
+// the option, of the next address slot.
+type RouteOption struct {
+	Pointer uint8
+	Route   [][4]byte
+}
+
+// Route decodes a Record Route, Loose Source Route or Strict Source Route
+// option.
+func (o Option) Route() (*RouteOption, error) {
+	if o.Type != IP_OPTION_RECORD_ROUTE && o.Type != IP_OPTION_LSRR && o.Type != IP_OPTION_SSRR {
+		return nil, fmt.Errorf("not a route option")
+	}
+	if len(o.Data) < 1 || (len(o.Data)-1)%4 != 0 || o.Data[0] < 4 {
+		return nil, fmt.Errorf("invalid route option")
+	}
+
+	route := &RouteOption{
+		Pointer: o.Data[0],
+		Route:   make([][4]byte, (len(o.Data)-1)/4),
+	}
+	for i := range route.Route {
+		copy(route.Route[i][:], o.Data[1+4*i:5+4*i])
+	}
+	return route, nil
+}
+
+// Create a Record Route option with room for slots addresses. It panics if
+// slots exceeds IP_ROUTE_MAX_SLOTS.
+func NewRecordRouteOption(slots int) Option {
+	if slots > IP_ROUTE_MAX_SLOTS {
+		panic(fmt.Sprintf("internet: %d route slots, more than %d", slots, IP_ROUTE_MAX_SLOTS))
+	}
+	r := &RouteOption{Pointer: 4, Route: make([][4]byte, slots)}
+	return r.Option(IP_OPTION_RECORD_ROUTE)
+}
+
+// Create a Loose or Strict Source Route option through the addresses. It
+// panics if there are more than IP_ROUTE_MAX_SLOTS.
+func NewSourceRouteOption(strict bool, route [][4]byte) Option {
+	if len(route) > IP_ROUTE_MAX_SLOTS {
+		panic(fmt.Sprintf("internet: %d route slots, more than %d", len(route), IP_ROUTE_MAX_SLOTS))
+	}
+	r := &RouteOption{Pointer: 4, Route: route}
+	if strict {
+		return r.Option(IP_OPTION_SSRR)
+	}
+	return r.Option(IP_OPTION_LSRR)
+}
+
+// Option encodes the route as an option of type typ.
+func (r *RouteOption) Option(typ uint8) Option {
+	data := make([]byte, 1+4*len(r.Route))
+	data[0] = r.Pointer
+	for i, addr := range r.Route {
+		copy(data[1+4*i:5+4*i], addr[:])
+	}
+	return Option{Type: typ, Data: data}
+}
+
+// TimestampEntry is a slot of the Timestamp option. Addr is unused when the
+// flag is IP_TIMESTAMP_ONLY.
+type TimestampEntry struct {
+	Addr      [4]byte
+	Timestamp uint32
+}
+
+// TimestampOption is the body of the Timestamp option.
+type TimestampOption struct {
+	Pointer  uint8
+	Overflow uint8
+	Flag     uint8
+	Entries  []TimestampEntry
+}
+
+// Timestamp decodes a Timestamp option.
+func (o Option) Timestamp() (*TimestampOption, error) {
+	if o.Type != IP_OPTION_TIMESTAMP {
+		return nil, fmt.Errorf("not a timestamp option")
+	}
+	if len(o.Data) < 2 || o.Data[0] < 5 {
+		return nil, fmt.Errorf("invalid timestamp option")
+	}
+
+	ts := &TimestampOption{
+		Pointer:  o.Data[0],
+		Overflow: o.Data[1] >> 4,
+		Flag:     o.Data[1] & 0x0F,
+	}
+	size := 4
+	switch ts.Flag {
+	case IP_TIMESTAMP_ONLY:
+	case IP_TIMESTAMP_AND_ADDRESS, IP_TIMESTAMP_PRESPECIFIED:
+		size = 8
+	default:
+		return nil, fmt.Errorf("invalid timestamp option flag")
+	}
+	body := o.Data[2:]
+	if len(body)%size != 0 {
+		return nil, fmt.Errorf("invalid timestamp option")
+	}
+
+	ts.Entries = make([]TimestampEntry, len(body)/size)
+	for i := range ts.Entries {
+		entry := body[i*size : (i+1)*size]
+		if size == 8 {
+			copy(ts.Entries[i].Addr[:], entry[0:4])
+			entry = entry[4:]
+		}
+		ts.Entries[i].Timestamp = binary.BigEndian.Uint32(entry)
+	}
+	return ts, nil
+}
+
+// Create a Timestamp option with the flag and room for slots entries. It
+// panics if the option would not fit in IP_OPTIONS_MAX_LEN bytes: at most 9
+// entries with IP_TIMESTAMP_ONLY and 4 with the other flags.
+func NewTimestampOption(flag uint8, slots int) Option {
+	size := 4
+	if flag != IP_TIMESTAMP_ONLY {
+		size = 8
+	}
+	if 4+size*slots > IP_OPTIONS_MAX_LEN {
+		panic(fmt.Sprintf("internet: %d timestamp slots do not fit in %d bytes", slots, IP_OPTIONS_MAX_LEN))
+	}
+	ts := &TimestampOption{Pointer: 5, Flag: flag, Entries: make([]TimestampEntry, slots)}
+	return ts.Option()
+}
+
+// Option encodes the timestamp option.
+func (t *TimestampOption) Option() Option {
+	size := 4
+	if t.Flag != IP_TIMESTAMP_ONLY {
+		size = 8
+	}
+	data := make([]byte, 2+size*len(t.Entries))
+	data[0] = t.Pointer
+	data[1] = t.Overflow<<4 | t.Flag&0x0F
+	for i, entry := range t.Entries {
+		buf := data[2+i*size : 2+(i+1)*size]
+		if size == 8 {
+			copy(buf[0:4], entry.Addr[:])
+			buf = buf[4:]
+		}
+		binary.BigEndian.PutUint32(buf, entry.Timestamp)
+	}
+	return Option{Type: IP_OPTION_TIMESTAMP, Data: data}
+}
+
+// RouterAlert decodes a Router Alert option and returns its value.
+func (o Option) RouterAlert() (uint16, error) {
+	if o.Type != IP_OPTION_ROUTER_ALERT {
+		return 0, fmt.Errorf("not a router alert option")
+	}
+	if len(o.Data) != 2 {
+		return 0, fmt.Errorf("invalid router alert option")
+	}
+	return binary.BigEndian.Uint16(o.Data), nil
+}
+
+// Create a Router Alert option. A value of 0 asks routers to examine the
+// packet.
+func NewRouterAlertOption(value uint16) Option {
+	data := make([]byte, 2)
+	binary.BigEndian.PutUint16(data, value)
+	return Option{Type: IP_OPTION_ROUTER_ALERT, Data: data}
+}
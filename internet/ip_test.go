@@ -0,0 +1,149 @@
+package internet
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kawa1214/tcp-ip-go/network"
+)
+
+var (
+	testSrc = [4]byte{10, 0, 0, 1}
+	testDst = [4]byte{10, 0, 0, 2}
+)
+
+// Return a queue reading from one end of a pipe, the other end and the
+// channel its UDP packets are delivered to.
+func newTestQueue(t *testing.T) (*IpPacketQueue, *network.PipeDevice, chan IpPacket) {
+	t.Helper()
+	local, peer := network.NewPipe()
+	q := NewIpPacketQueue()
+	q.AddAddress(testDst)
+	delivered := make(chan IpPacket, QUEUE_SIZE)
+	q.Handle(UDP_PROTOCOL, func(pkt IpPacket) { delivered <- pkt })
+	q.ManageQueues(local)
+	t.Cleanup(func() {
+		q.Close()
+		peer.Close()
+	})
+	return q, peer, delivered
+}
+
+// Send the bytes of a packet from the other end of the pipe.
+func sendTestPacket(t *testing.T, peer *network.PipeDevice, data []byte) {
+	t.Helper()
+	if err := peer.Write(network.Packet{Buf: data, N: uintptr(len(data))}); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+}
+
+// Wait for a packet to be delivered to the UDP handler.
+func waitDelivered(t *testing.T, delivered chan IpPacket) IpPacket {
+	t.Helper()
+	select {
+	case pkt := <-delivered:
+		return pkt
+	case <-time.After(time.Second):
+		t.Fatalf("no packet delivered")
+		return IpPacket{}
+	}
+}
+
+// Return the bytes of a UDP packet from testSrc to testDst.
+func testUdpPacket(modify func(h *Header)) []byte {
+	payload := testPayload(8)
+	hdr := NewIp(testSrc, testDst, len(payload))
+	hdr.Protocol = UDP_PROTOCOL
+	if modify != nil {
+		modify(hdr)
+	}
+	return append(hdr.Marshal(), payload...)
+}
+
+func TestReceiveInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(h *Header)
+		corrupt func(pkt []byte) []byte
+		want    Stats
+	}{
+		{
+			name:    "truncated header",
+			corrupt: func(pkt []byte) []byte { return pkt[:IP_HEADER_MIN_LEN-1] },
+			want:    Stats{InTruncated: 1},
+		},
+		{
+			name:   "truncated payload",
+			modify: func(h *Header) { h.TotalLength++ },
+			want:   Stats{InTruncated: 1},
+		},
+		{
+			name:   "bad version",
+			modify: func(h *Header) { h.Version = 6 },
+			want:   Stats{InBadVersion: 1},
+		},
+		{
+			name:   "header length below 5",
+			modify: func(h *Header) { h.IHL = 4 },
+			want:   Stats{InBadHeaderLength: 1},
+		},
+		{
+			name:   "total length below header length",
+			modify: func(h *Header) { h.TotalLength = IP_HEADER_MIN_LEN - 1 },
+			want:   Stats{InBadTotalLength: 1},
+		},
+		{
+			name:    "bad checksum",
+			corrupt: func(pkt []byte) []byte { pkt[10] ^= 1; return pkt },
+			want:    Stats{InBadChecksum: 1},
+		},
+		{
+			name:   "not addressed to us",
+			modify: func(h *Header) { h.DstIP = [4]byte{10, 0, 0, 3} },
+			want:   Stats{InAddrErrors: 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, peer, delivered := newTestQueue(t)
+			pkt := testUdpPacket(tt.modify)
+			if tt.corrupt != nil {
+				pkt = tt.corrupt(pkt)
+			}
+			sendTestPacket(t, peer, pkt)
+
+			// The reader handles packets in order, so once a valid packet
+			// is delivered the invalid one has been counted.
+			sendTestPacket(t, peer, testUdpPacket(nil))
+			waitDelivered(t, delivered).Packet.Release()
+			select {
+			case <-delivered:
+				t.Errorf("invalid packet was delivered")
+			default:
+			}
+
+			want := tt.want
+			want.InReceives = 2
+			want.InDelivers = 1
+			if got := q.Stats(); got != want {
+				t.Errorf("stats = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestReceiveTrimsPadding(t *testing.T) {
+	q, peer, delivered := newTestQueue(t)
+	pkt := testUdpPacket(nil)
+	sendTestPacket(t, peer, append(pkt, make([]byte, 6)...))
+
+	got := waitDelivered(t, delivered)
+	defer got.Packet.Release()
+	if int(got.Packet.N) != len(pkt) {
+		t.Errorf("delivered %d bytes, want the %d of TotalLength", got.Packet.N, len(pkt))
+	}
+	if stats := q.Stats(); stats.InReceives != 1 || stats.InDelivers != 1 {
+		t.Errorf("stats = %+v, want one packet received and delivered", stats)
+	}
+}
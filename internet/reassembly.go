@@ -0,0 +1,243 @@
+package internet
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/kawa1214/tcp-ip-go/network"
+)
+
+const (
+	// Time a datagram may wait for its missing fragments.
+	REASSEMBLY_TIMEOUT = 30 * time.Second
+	// Memory all incomplete datagrams may hold. When a new fragment does not
+	// fit, the oldest datagrams are discarded.
+	REASSEMBLY_MAX_BYTES = 4 << 20
+	// Memory charged per fragment on top of its payload, so floods of tiny
+	// fragments hit the limit too.
+	REASSEMBLY_FRAGMENT_OVERHEAD = 64
+	// Largest datagram that can be reassembled.
+	REASSEMBLY_MAX_SIZE = 65535
+)
+
+type fragmentKey struct {
+	src      [4]byte
+	dst      [4]byte
+	protocol uint8
+	id       uint16
+}
+
+type fragment struct {
+	start int
+	end   int
+	data  []byte
+}
+
+// datagram is a datagram waiting for its fragments. total is the payload
+// length, known once the last fragment has arrived, otherwise -1.
+type datagram struct {
+	key       fragmentKey
+	first     *Header
+	protocol  uint16
+	fragments []fragment
+	total     int
+	size      int
+	created   time.Time
+}
+
+// reassembler puts fragmented datagrams back together. A fragment that
+// overlaps another one with different bounds discards the whole datagram,
+// since overlaps only come from broken or malicious senders; exact
+// duplicates are ignored.
+type reassembler struct {
+	datagrams map[fragmentKey]*datagram
+	size      int
+	stats     *counters
+	lock      sync.Mutex
+}
+
+func newReassembler(stats *counters) *reassembler {
+	return &reassembler{
+		datagrams: make(map[fragmentKey]*datagram),
+		stats:     stats,
+	}
+}
+
+// Add a fragment. If it completes its datagram, the reassembled header and
+// packet are returned with ok set.
+func (r *reassembler) add(hdr *Header, pkt network.Packet, now time.Time) (*Header, network.Packet, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.stats.reasmReqds.Add(1)
+
+	hdrLen := int(hdr.IHL) * 4
+	start := int(hdr.FragmentOffset) * 8
+	end := start + int(hdr.TotalLength) - hdrLen
+	more := hdr.Flags&FLAG_MF != 0
+	if end > REASSEMBLY_MAX_SIZE-hdrLen || (more && (end-start)%8 != 0) || (more && end == start) {
+		r.stats.reasmFails.Add(1)
+		return nil, network.Packet{}, false
+	}
+
+	key := fragmentKey{src: hdr.SrcIP, dst: hdr.DstIP, protocol: hdr.Protocol, id: hdr.ID}
+	d, ok := r.datagrams[key]
+	if !ok {
+		d = &datagram{key: key, total: -1, created: now}
+		r.datagrams[key] = d
+	}
+
+	if !more {
+		last := len(d.fragments) - 1
+		if (d.total >= 0 && d.total != end) || (last >= 0 && d.fragments[last].end > end) {
+			r.discard(d)
+			return nil, network.Packet{}, false
+		}
+		d.total = end
+	}
+	if d.total >= 0 && end > d.total {
+		r.discard(d)
+		return nil, network.Packet{}, false
+	}
+
+	i := sort.Search(len(d.fragments), func(i int) bool {
+		return d.fragments[i].start >= start
+	})
+	if i < len(d.fragments) && d.fragments[i].start == start && d.fragments[i].end == end {
+		r.stats.reasmDuplicates.Add(1)
+		return nil, network.Packet{}, false
+	}
+	if (i > 0 && d.fragments[i-1].end > start) || (i < len(d.fragments) && d.fragments[i].start < end) {
+		r.stats.reasmOverlaps.Add(1)
+		r.remove(d)
+		return nil, network.Packet{}, false
+	}
+
+	cost := end - start + REASSEMBLY_FRAGMENT_OVERHEAD
+	r.evict(cost, d)
+	if r.size+cost > REASSEMBLY_MAX_BYTES {
+		r.discard(d)
+		return nil, network.Packet{}, false
+	}
+
+	data := make([]byte, end-start)
+	copy(data, pkt.Buf[hdrLen:hdrLen+end-start])
+	d.fragments = append(d.fragments, fragment{})
+	copy(d.fragments[i+1:], d.fragments[i:])
+	d.fragments[i] = fragment{start: start, end: end, data: data}
+	d.size += cost
+	r.size += cost
+	if start == 0 {
+		d.first = hdr
+		d.protocol = pkt.Protocol
+	}
+
+	if !d.complete() {
+		return nil, network.Packet{}, false
+	}
+	r.remove(d)
+	r.stats.reasmOKs.Add(1)
+	return d.assemble()
+}
+
+// Report whether every byte of the datagram has arrived.
+func (d *datagram) complete() bool {
+	if d.total < 0 || d.first == nil {
+		return false
+	}
+	next := 0
+	for _, f := range d.fragments {
+		if f.start != next {
+			return false
+		}
+		next = f.end
+	}
+	return next == d.total
+}
+
+// Return the datagram with the header of its first fragment.
+func (d *datagram) assemble() (*Header, network.Packet, bool) {
+	hdr := *d.first
+	hdr.Flags &^= FLAG_MF
+	hdr.FragmentOffset = 0
+	hdr.TotalLength = uint16(hdr.Len() + d.total)
+
+	buf := network.AllocBuffer(d.total)
+	payload := buf.Put(d.total)
+	for _, f := range d.fragments {
+		copy(payload[f.start:f.end], f.data)
+	}
+	hdr.MarshalTo(buf.Push(hdr.Len()))
+
+	pkt := buf.Packet()
+	pkt.Protocol = d.protocol
+	return &hdr, pkt, true
+}
+
+// Discard datagrams older than REASSEMBLY_TIMEOUT. For those whose first
+// fragment arrived, that fragment's header and the start of its payload are
+// returned, so the sender can be sent a Time Exceeded message.
+func (r *reassembler) expire(now time.Time) []IpPacket {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var expired []IpPacket
+	for _, d := range r.datagrams {
+		if now.Sub(d.created) < REASSEMBLY_TIMEOUT {
+			continue
+		}
+		r.stats.reasmTimeouts.Add(1)
+		r.remove(d)
+		if d.first != nil {
+			expired = append(expired, d.head())
+		}
+	}
+	return expired
+}
+
+// Return the first fragment's header followed by the first 8 bytes of its
+// payload, all an ICMP error quotes.
+func (d *datagram) head() IpPacket {
+	hdr := *d.first
+	data := d.fragments[0].data
+	if len(data) > 8 {
+		data = data[:8]
+	}
+
+	buf := network.AllocBuffer(len(data))
+	copy(buf.Put(len(data)), data)
+	hdr.MarshalTo(buf.Push(hdr.Len()))
+
+	pkt := buf.Packet()
+	pkt.Protocol = d.protocol
+	return IpPacket{IpHeader: &hdr, Packet: pkt}
+}
+
+// Discard the oldest datagrams other than keep until cost more bytes fit
+// under REASSEMBLY_MAX_BYTES.
+func (r *reassembler) evict(cost int, keep *datagram) {
+	for r.size+cost > REASSEMBLY_MAX_BYTES {
+		var oldest *datagram
+		for _, d := range r.datagrams {
+			if d != keep && (oldest == nil || d.created.Before(oldest.created)) {
+				oldest = d
+			}
+		}
+		if oldest == nil {
+			return
+		}
+		r.discard(oldest)
+	}
+}
+
+// Drop an incomplete datagram and count the failure.
+func (r *reassembler) discard(d *datagram) {
+	r.stats.reasmFails.Add(1)
+	r.remove(d)
+}
+
+func (r *reassembler) remove(d *datagram) {
+	r.size -= d.size
+	delete(r.datagrams, d.key)
+}
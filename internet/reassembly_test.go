@@ -0,0 +1,235 @@
+package internet
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/kawa1214/tcp-ip-go/network"
+)
+
+// Return the payload and its fragments for the given MTU.
+func testFragments(t *testing.T, id uint16, size, mtu int) ([]byte, []network.Packet) {
+	t.Helper()
+	payload := testPayload(size)
+	hdr := NewIp([4]byte{10, 0, 0, 1}, [4]byte{10, 0, 0, 2}, len(payload))
+	hdr.Flags = 0
+	hdr.ID = id
+	fragments, err := fragmentPacket(hdr, newTestPacket(hdr, payload), mtu)
+	if err != nil {
+		t.Fatalf("fragmentPacket: %s", err)
+	}
+	return payload, fragments
+}
+
+// Feed a fragment to the reassembler.
+func addFragment(t *testing.T, r *reassembler, frag network.Packet, now time.Time) (*Header, network.Packet, bool) {
+	t.Helper()
+	hdr, err := Unmarshal(frag.Buf[:frag.N])
+	if err != nil {
+		t.Fatalf("Unmarshal: %s", err)
+	}
+	return r.add(hdr, frag, now)
+}
+
+// Return a fragment starting at offset with size bytes of payload.
+func testFragment(id uint16, offset, size int, more bool) network.Packet {
+	hdr := NewIp([4]byte{10, 0, 0, 1}, [4]byte{10, 0, 0, 2}, size)
+	hdr.Flags = 0
+	if more {
+		hdr.Flags = FLAG_MF
+	}
+	hdr.ID = id
+	hdr.FragmentOffset = uint16(offset / 8)
+	return newTestPacket(hdr, testPayload(size))
+}
+
+func TestReassemble(t *testing.T) {
+	tests := []struct {
+		name  string
+		order []int
+		// Extra fragment fed after the ones in order, if any.
+		extra    func() network.Packet
+		complete bool
+		want     Stats
+	}{
+		{
+			name:     "in order",
+			order:    []int{0, 1, 2, 3},
+			complete: true,
+			want:     Stats{ReasmReqds: 4, ReasmOKs: 1},
+		},
+		{
+			name:     "out of order",
+			order:    []int{3, 1, 0, 2},
+			complete: true,
+			want:     Stats{ReasmReqds: 4, ReasmOKs: 1},
+		},
+		{
+			name:     "last first",
+			order:    []int{3, 2, 1, 0},
+			complete: true,
+			want:     Stats{ReasmReqds: 4, ReasmOKs: 1},
+		},
+		{
+			name:     "duplicate",
+			order:    []int{0, 1, 1, 2, 0, 3},
+			complete: true,
+			want:     Stats{ReasmReqds: 6, ReasmOKs: 1, ReasmDuplicates: 2},
+		},
+		{
+			name:  "missing fragment",
+			order: []int{0, 1, 3},
+			want:  Stats{ReasmReqds: 3},
+		},
+		{
+			name:  "overlap",
+			order: []int{0, 1},
+			extra: func() network.Packet { return testFragment(1, 8, 1000, true) },
+			want:  Stats{ReasmReqds: 3, ReasmOverlaps: 1},
+		},
+		{
+			name:  "payload not a multiple of 8",
+			order: []int{0},
+			extra: func() network.Packet { return testFragment(1, 2960, 12, true) },
+			want:  Stats{ReasmReqds: 2, ReasmFails: 1},
+		},
+		{
+			name:  "conflicting last fragments",
+			order: []int{3},
+			extra: func() network.Packet { return testFragment(1, 2960, 16, false) },
+			want:  Stats{ReasmReqds: 2, ReasmFails: 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Four fragments of 1000 bytes.
+			payload, fragments := testFragments(t, 1, 4000, 1020)
+			if len(fragments) != 4 {
+				t.Fatalf("got %d fragments, want 4", len(fragments))
+			}
+
+			var stats counters
+			r := newReassembler(&stats)
+			now := time.Now()
+
+			var hdr *Header
+			var pkt network.Packet
+			var complete bool
+			for _, i := range tt.order {
+				if h, p, ok := addFragment(t, r, fragments[i], now); ok {
+					hdr, pkt, complete = h, p, true
+				}
+			}
+			if tt.extra != nil {
+				if h, p, ok := addFragment(t, r, tt.extra(), now); ok {
+					hdr, pkt, complete = h, p, true
+				}
+			}
+
+			if complete != tt.complete {
+				t.Fatalf("complete = %t, want %t", complete, tt.complete)
+			}
+			if complete {
+				if hdr.Flags&FLAG_MF != 0 || hdr.FragmentOffset != 0 {
+					t.Errorf("reassembled header still marks a fragment: %+v", hdr)
+				}
+				if int(hdr.TotalLength) != int(pkt.N) || int(pkt.N) != hdr.Len()+len(payload) {
+					t.Errorf("TotalLength = %d, N = %d, want %d", hdr.TotalLength, pkt.N, hdr.Len()+len(payload))
+				}
+				if !bytes.Equal(pkt.Buf[hdr.Len():pkt.N], payload) {
+					t.Errorf("reassembled payload differs from the original")
+				}
+				if _, err := Unmarshal(pkt.Buf[:pkt.N]); err != nil {
+					t.Errorf("reassembled packet: Unmarshal: %s", err)
+				}
+				if len(r.datagrams) != 0 || r.size != 0 {
+					t.Errorf("reassembler still holds %d datagrams, %d bytes", len(r.datagrams), r.size)
+				}
+			}
+			if got := stats.snapshot(); got != tt.want {
+				t.Errorf("stats = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReassembleTimeout(t *testing.T) {
+	tests := []struct {
+		name     string
+		order    []int
+		wantHead bool
+	}{
+		{name: "first fragment received", order: []int{0, 2}, wantHead: true},
+		{name: "first fragment missing", order: []int{1, 2}, wantHead: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, fragments := testFragments(t, 1, 4000, 1500)
+			var stats counters
+			r := newReassembler(&stats)
+			now := time.Now()
+			for _, i := range tt.order {
+				addFragment(t, r, fragments[i], now)
+			}
+
+			if expired := r.expire(now.Add(REASSEMBLY_TIMEOUT - time.Second)); len(expired) != 0 {
+				t.Fatalf("expired %d datagrams before the timeout", len(expired))
+			}
+			expired := r.expire(now.Add(REASSEMBLY_TIMEOUT))
+			if got := len(expired) == 1; got != tt.wantHead {
+				t.Fatalf("expire returned %d heads, want head = %t", len(expired), tt.wantHead)
+			}
+			if tt.wantHead {
+				head := expired[0]
+				if head.IpHeader.FragmentOffset != 0 || int(head.Packet.N) != head.IpHeader.Len()+8 {
+					t.Errorf("head = %+v with %d bytes, want the first fragment's header and 8 bytes", head.IpHeader, head.Packet.N)
+				}
+			}
+			if len(r.datagrams) != 0 || r.size != 0 {
+				t.Errorf("reassembler still holds %d datagrams, %d bytes", len(r.datagrams), r.size)
+			}
+			if got := stats.snapshot(); got.ReasmTimeouts != 1 || got.ReasmFails != 0 {
+				t.Errorf("ReasmTimeouts = %d, ReasmFails = %d, want 1 and 0", got.ReasmTimeouts, got.ReasmFails)
+			}
+
+			// The remaining fragments start a new datagram.
+			for i := range fragments {
+				if _, _, ok := addFragment(t, r, fragments[i], now.Add(REASSEMBLY_TIMEOUT)); ok && i != len(fragments)-1 {
+					t.Errorf("completed after fragment %d", i)
+				}
+			}
+		})
+	}
+}
+
+func TestReassembleMemoryLimit(t *testing.T) {
+	const size = 60000
+	var stats counters
+	r := newReassembler(&stats)
+	now := time.Now()
+
+	// Every datagram holds its first 59992 bytes, so only so many fit.
+	fit := REASSEMBLY_MAX_BYTES / (size - 8 + REASSEMBLY_FRAGMENT_OVERHEAD)
+	for id := 0; id <= fit; id++ {
+		frag := testFragment(uint16(id), 0, size-8, true)
+		if _, _, ok := addFragment(t, r, frag, now.Add(time.Duration(id)*time.Millisecond)); ok {
+			t.Fatalf("datagram %d completed", id)
+		}
+		if r.size > REASSEMBLY_MAX_BYTES {
+			t.Fatalf("reassembler holds %d bytes, more than %d", r.size, REASSEMBLY_MAX_BYTES)
+		}
+	}
+
+	if len(r.datagrams) != fit {
+		t.Errorf("reassembler holds %d datagrams, want %d", len(r.datagrams), fit)
+	}
+	if _, ok := r.datagrams[fragmentKey{src: [4]byte{10, 0, 0, 1}, dst: [4]byte{10, 0, 0, 2}, protocol: TCP_PROTOCOL, id: 0}]; ok {
+		t.Errorf("oldest datagram was not evicted")
+	}
+	if got := stats.snapshot(); got.ReasmFails != 1 {
+		t.Errorf("ReasmFails = %d, want 1", got.ReasmFails)
+	}
+}
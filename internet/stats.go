@@ -0,0 +1,124 @@
+package internet
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// Stats holds the counters of an IpPacketQueue. Every dropped incoming
+// packet, and every discarded incomplete datagram, is counted under exactly
+// one reason.
+type Stats struct {
+	// Packets read from the device.
+	InReceives uint64
+	// Packets of another EtherType than IPv4.
+	InNotIPv4 uint64
+	// Packets passed to a protocol handler.
+	InDelivers uint64
+	// Packets of a protocol without a handler.
+	InUnknownProtos uint64
+	// Packets shorter than their header or their total length.
+	InTruncated uint64
+	// Packets whose version is not 4.
+	InBadVersion uint64
+	// Packets whose IHL is below 5.
+	InBadHeaderLength uint64
+	// Packets whose total length is shorter than their header.
+	InBadTotalLength uint64
+	// Packets whose header checksum does not verify.
+	InBadChecksum uint64
+	// Packets with a malformed option.
+	InBadOptions uint64
+	// Packets not addressed to one of our addresses.
+	InAddrErrors uint64
+
+	// Fragments received.
+	ReasmReqds uint64
+	// Datagrams reassembled.
+	ReasmOKs uint64
+	// Fragments or incomplete datagrams discarded because they were
+	// malformed, inconsistent or evicted to stay under the memory limit.
+	// Timeouts, overlaps and duplicates are counted separately.
+	ReasmFails uint64
+	// Incomplete datagrams discarded after REASSEMBLY_TIMEOUT.
+	ReasmTimeouts uint64
+	// Incomplete datagrams discarded because of overlapping fragments.
+	ReasmOverlaps uint64
+	// Fragments ignored because they duplicate one already received.
+	ReasmDuplicates uint64
+
+	// Outgoing packets fragmented.
+	FragOKs uint64
+	// Fragments created.
+	FragCreates uint64
+	// Outgoing packets larger than the MTU that could not be fragmented,
+	// most often because of the Don't Fragment flag.
+	FragFails uint64
+}
+
+// counters is the concurrency-safe backing store of Stats.
+type counters struct {
+	inReceives        atomic.Uint64
+	inNotIPv4         atomic.Uint64
+	inDelivers        atomic.Uint64
+	inUnknownProtos   atomic.Uint64
+	inTruncated       atomic.Uint64
+	inBadVersion      atomic.Uint64
+	inBadHeaderLength atomic.Uint64
+	inBadTotalLength  atomic.Uint64
+	inBadChecksum     atomic.Uint64
+	inBadOptions      atomic.Uint64
+	inAddrErrors      atomic.Uint64
+	reasmReqds        atomic.Uint64
+	reasmOKs          atomic.Uint64
+	reasmFails        atomic.Uint64
+	reasmTimeouts     atomic.Uint64
+	reasmOverlaps     atomic.Uint64
+	reasmDuplicates   atomic.Uint64
+	fragOKs           atomic.Uint64
+	fragCreates       atomic.Uint64
+	fragFails         atomic.Uint64
+}
+
+// Count a packet dropped because of err, as returned by Unmarshal.
+func (c *counters) invalid(err error) {
+	switch {
+	case err == ErrTruncated:
+		c.inTruncated.Add(1)
+	case err == ErrBadVersion:
+		c.inBadVersion.Add(1)
+	case err == ErrBadHeaderLength:
+		c.inBadHeaderLength.Add(1)
+	case err == ErrBadTotalLength:
+		c.inBadTotalLength.Add(1)
+	case err == ErrBadChecksum:
+		c.inBadChecksum.Add(1)
+	case errors.Is(err, ErrBadOption):
+		c.inBadOptions.Add(1)
+	}
+}
+
+func (c *counters) snapshot() Stats {
+	return Stats{
+		InReceives:        c.inReceives.Load(),
+		InNotIPv4:         c.inNotIPv4.Load(),
+		InDelivers:        c.inDelivers.Load(),
+		InUnknownProtos:   c.inUnknownProtos.Load(),
+		InTruncated:       c.inTruncated.Load(),
+		InBadVersion:      c.inBadVersion.Load(),
+		InBadHeaderLength: c.inBadHeaderLength.Load(),
+		InBadTotalLength:  c.inBadTotalLength.Load(),
+		InBadChecksum:     c.inBadChecksum.Load(),
+		InBadOptions:      c.inBadOptions.Load(),
+		InAddrErrors:      c.inAddrErrors.Load(),
+		ReasmReqds:        c.reasmReqds.Load(),
+		ReasmOKs:          c.reasmOKs.Load(),
+		ReasmFails:        c.reasmFails.Load(),
+		ReasmTimeouts:     c.reasmTimeouts.Load(),
+		ReasmOverlaps:     c.reasmOverlaps.Load(),
+		ReasmDuplicates:   c.reasmDuplicates.Load(),
+		FragOKs:           c.fragOKs.Load(),
+		FragCreates:       c.fragCreates.Load(),
+		FragFails:         c.fragFails.Load(),
+	}
+}
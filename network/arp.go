@@ -0,0 +1,302 @@
+package network
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	ARP_HEADER_LEN         = 28
+	ARP_HARDWARE_TYPE      = 1
+	ARP_OP_REQUEST         = 1
+	ARP_OP_REPLY           = 2
+	ARP_CACHE_TIMEOUT      = 60 * time.Second
+	ARP_RETRY_INTERVAL     = 1 * time.Second
+	ARP_MAX_RETRIES        = 3
+	ARP_PENDING_QUEUE_SIZE = QUEUE_SIZE
+)
+
+type ArpHeader struct {
+	HardwareType uint16
+	ProtocolType uint16
+	HardwareLen  uint8
+	ProtocolLen  uint8
+	Op           uint16
+	SenderMAC    HardwareAddr
+	SenderIP     [4]byte
+	TargetMAC    HardwareAddr
+	TargetIP     [4]byte
+}
+
+// Create a new ARP header from packet.
+func unmarshalArp(pkt []byte) (*ArpHeader, error) {
+	if len(pkt) < ARP_HEADER_LEN {
+		return nil, fmt.Errorf("invalid ARP header length")
+	}
+
+	header := &ArpHeader{
+		HardwareType: binary.BigEndian.Uint16(pkt[0:2]),
+		ProtocolType: binary.BigEndian.Uint16(pkt[2:4]),
+		HardwareLen:  pkt[4],
+		ProtocolLen:  pkt[5],
+		Op:           binary.BigEndian.Uint16(pkt[6:8]),
+	}
+	if header.HardwareType != ARP_HARDWARE_TYPE || header.ProtocolType != ETHER_TYPE_IPV4 ||
+		header.HardwareLen != 6 || header.ProtocolLen != 4 {
+		return nil, fmt.Errorf("unsupported ARP packet")
+	}
+
+	copy(header.SenderMAC[:], pkt[8:14])
+	copy(header.SenderIP[:], pkt[14:18])
+	copy(header.TargetMAC[:], pkt[18:24])
+	copy(header.TargetIP[:], pkt[24:28])
+
+	return header, nil
+}
+
+// Create a new ARP header for IPv4 over Ethernet.
+func NewArp(op uint16, senderMAC HardwareAddr, senderIP [4]byte, targetMAC HardwareAddr, targetIP [4]byte) *ArpHeader {
+	return &ArpHeader{
+		HardwareType: ARP_HARDWARE_TYPE,
+		ProtocolType: ETHER_TYPE_IPV4,
+		HardwareLen:  6,
+		ProtocolLen:  4,
+		Op:           op,
+		SenderMAC:    senderMAC,
+		SenderIP:     senderIP,
+		TargetMAC:    targetMAC,
+		TargetIP:     targetIP,
+	}
+}
+
+// Return a byte slice of the packet.
+func (h *ArpHeader) Marshal() []byte {
+	pkt := make([]byte, ARP_HEADER_LEN)
+	binary.BigEndian.PutUint16(pkt[0:2], h.HardwareType)
+	binary.BigEndian.PutUint16(pkt[2:4], h.ProtocolType)
+	pkt[4] = h.HardwareLen
+	pkt[5] = h.ProtocolLen
+	binary.BigEndian.PutUint16(pkt[6:8], h.Op)
+	copy(pkt[8:14], h.SenderMAC[:])
+	copy(pkt[14:18], h.SenderIP[:])
+	copy(pkt[18:24], h.TargetMAC[:])
+	copy(pkt[24:28], h.TargetIP[:])
+	return pkt
+}
+
+type neighborState int
+
+const (
+	neighborIncomplete neighborState = iota
+	neighborReachable
+	neighborStatic
+)
+
+type neighborEntry struct {
+	mac     HardwareAddr
+	state   neighborState
+	expires time.Time
+	retries int
+	srcIP   [4]byte
+	pending []Packet
+}
+
+// neighborCache maps IPv4 addresses on the link to hardware addresses.
+// Unresolved entries hold the packets waiting for the address.
+type neighborCache struct {
+	entries map[[4]byte]*neighborEntry
+	stats   *counters
+	lock    sync.Mutex
+}
+
+func newNeighborCache(stats *counters) *neighborCache {
+	return &neighborCache{
+		entries: make(map[[4]byte]*neighborEntry),
+		stats:   stats,
+	}
+}
+
+// Look up the hardware address of ip. If it is not resolved, the packet is
+// queued on the entry and request reports whether an ARP request is needed.
+func (c *neighborCache) lookup(ip [4]byte, pkt Packet) (mac HardwareAddr, ok bool, request bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	entry, found := c.entries[ip]
+	if found && entry.state == neighborStatic {
+		return entry.mac, true, false
+	}
+	if found && entry.state == neighborReachable && now.Before(entry.expires) {
+		return entry.mac, true, false
+	}
+	if found && entry.state == neighborIncomplete {
+		if len(entry.pending) >= ARP_PENDING_QUEUE_SIZE {
+			entry.pending[0].Release()
+			entry.pending = entry.pending[1:]
+			c.stats.txDropped.Add(1)
+			c.stats.queueFull.Add(1)
+		}
+		entry.pending = append(entry.pending, pkt)
+		return HardwareAddr{}, false, false
+	}
+
+	var srcIP [4]byte
+	copy(srcIP[:], pkt.Buf[12:16])
+	c.entries[ip] = &neighborEntry{
+		state:   neighborIncomplete,
+		expires: now.Add(ARP_RETRY_INTERVAL),
+		srcIP:   srcIP,
+		pending: []Packet{pkt},
+	}
+	return HardwareAddr{}, false, true
+}
+
+// Record the hardware address of ip and return the packets waiting for it.
+func (c *neighborCache) resolve(ip [4]byte, mac HardwareAddr, static bool) []Packet {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry, found := c.entries[ip]
+	if found && entry.state == neighborStatic && !static {
+		return nil
+	}
+	if !found {
+		entry = &neighborEntry{}
+		c.entries[ip] = entry
+	}
+
+	pending := entry.pending
+	entry.mac = mac
+	entry.state = neighborReachable
+	if static {
+		entry.state = neighborStatic
+	}
+	entry.expires = time.Now().Add(ARP_CACHE_TIMEOUT)
+	entry.retries = 0
+	entry.pending = nil
+
+	return pending
+}
+
+// Update the entry of ip only if it already exists.
+func (c *neighborCache) update(ip [4]byte, mac HardwareAddr) ([]Packet, bool) {
+	c.lock.Lock()
+	_, found := c.entries[ip]
+	c.lock.Unlock()
+
+	if !found {
+		return nil, false
+	}
+	return c.resolve(ip, mac, false), true
+}
+
+type arpRetry struct {
+	srcIP    [4]byte
+	targetIP [4]byte
+}
+
+// Remove aged out entries and return the unresolved ones to request again.
+func (c *neighborCache) expire(now time.Time) []arpRetry {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	retries := make([]arpRetry, 0)
+	for ip, entry := range c.entries {
+		if entry.state == neighborStatic || now.Before(entry.expires) {
+			continue
+		}
+		if entry.state == neighborIncomplete && entry.retries < ARP_MAX_RETRIES {
+			entry.retries++
+			entry.expires = now.Add(ARP_RETRY_INTERVAL)
+			retries = append(retries, arpRetry{srcIP: entry.srcIP, targetIP: ip})
+			continue
+		}
+		for _, pkt := range entry.pending {
+			pkt.Release()
+		}
+		if len(entry.pending) > 0 {
+			c.stats.txDropped.Add(uint64(len(entry.pending)))
+			log.Printf("arp: %d.%d.%d.%d unreachable, dropped %d packets", ip[0], ip[1], ip[2], ip[3], len(entry.pending))
+		}
+		delete(c.entries, ip)
+	}
+
+	return retries
+}
+
+// Handle a received ARP packet.
+func (e *EthernetDevice) recvArp(_ *EthernetHeader, pkt Packet) {
+	arp, err := unmarshalArp(pkt.Buf[:pkt.N])
+	if err != nil {
+		log.Printf("unmarshal error: %s", err)
+		return
+	}
+
+	if arp.SenderIP == [4]byte{} {
+		return
+	}
+
+	addr := e.address()
+	pending, merged := e.neighbors.update(arp.SenderIP, arp.SenderMAC)
+	if addr == [4]byte{} || arp.TargetIP != addr {
+		e.flush(arp.SenderMAC, pending)
+		return
+	}
+	if !merged {
+		pending = e.neighbors.resolve(arp.SenderIP, arp.SenderMAC, false)
+	}
+	e.flush(arp.SenderMAC, pending)
+
+	if arp.Op == ARP_OP_REQUEST {
+		reply := NewArp(ARP_OP_REPLY, e.mac, addr, arp.SenderMAC, arp.SenderIP)
+		buf := reply.Marshal()
+		err := e.WriteFrame(arp.SenderMAC, ETHER_TYPE_ARP, Packet{Buf: buf, N: uintptr(len(buf))})
+		if err != nil {
+			log.Printf("write error: %s", err.Error())
+		}
+	}
+}
+
+// Broadcast a request for the hardware address of target.
+func (e *EthernetDevice) sendArpRequest(srcIP, target [4]byte) error {
+	if addr := e.address(); addr != [4]byte{} {
+		srcIP = addr
+	}
+	req := NewArp(ARP_OP_REQUEST, e.mac, srcIP, HardwareAddr{}, target)
+	buf := req.Marshal()
+	return e.WriteFrame(BroadcastHardwareAddr, ETHER_TYPE_ARP, Packet{Buf: buf, N: uintptr(len(buf))})
+}
+
+// Send the packets that were waiting for mac to be resolved.
+func (e *EthernetDevice) flush(mac HardwareAddr, pending []Packet) {
+	for _, pkt := range pending {
+		err := e.WriteFrame(mac, ETHER_TYPE_IPV4, pkt)
+		if err != nil {
+			log.Printf("write error: %s", err.Error())
+		}
+	}
+}
+
+// Periodically age out neighbor entries and retry unresolved ones.
+func (e *EthernetDevice) ageNeighbors() {
+	ticker := time.NewTicker(ARP_RETRY_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, retry := range e.neighbors.expire(now) {
+				err := e.sendArpRequest(retry.srcIP, retry.targetIP)
+				if err != nil {
+					log.Printf("write error: %s", err.Error())
+				}
+			}
+		}
+	}
+}
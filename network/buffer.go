@@ -0,0 +1,191 @@
+package network
+
+import "sync"
+
+const (
+	// Room reserved in front of the data of a buffer, enough for the
+	// largest TCP and IPv4 headers, an Ethernet header, a virtio-net header
+	// and tun_pi to be prepended without copying.
+	BUFFER_HEADROOM = 60 + 60 + ETHERNET_HEADER_LEN + VNET_HDR_LEN + TUN_PI_LEN
+	// Size of the buffers kept in the pool.
+	BUFFER_SIZE = BUFFER_HEADROOM + PACKET_SIZE
+	// Size of the buffers kept in the pool for larger packets, such as the
+	// coalesced segments a device opened with Offload reads.
+	BUFFER_LARGE_SIZE = BUFFER_HEADROOM + TUN_PI_LEN + VNET_HDR_LEN + ETHERNET_HEADER_LEN + GSO_MAX_SIZE
+)
+
+var bufferPool = newBufferPool(BUFFER_SIZE)
+var largeBufferPool = newBufferPool(BUFFER_LARGE_SIZE)
+
+func newBufferPool(size int) *sync.Pool {
+	pool := &sync.Pool{}
+	pool.New = func() any {
+		return &Buffer{buf: make([]byte, size)}
+	}
+	return pool
+}
+
+// Buffer holds the data of a packet with free space in front of it, so each
+// layer can prepend its header in place on the way down and strip it on the
+// way up, like the kernel's sk_buff.
+type Buffer struct {
+	buf  []byte
+	head int
+	tail int
+	pool *sync.Pool
+}
+
+// AllocBuffer returns an empty buffer with BUFFER_HEADROOM bytes of headroom
+// and room for at least size bytes of data. Buffers that fit are taken from
+// a pool and go back to it when released.
+func AllocBuffer(size int) *Buffer {
+	var pool *sync.Pool
+	switch {
+	case BUFFER_HEADROOM+size <= BUFFER_SIZE:
+		pool = bufferPool
+	case BUFFER_HEADROOM+size <= BUFFER_LARGE_SIZE:
+		pool = largeBufferPool
+	}
+
+	var b *Buffer
+	if pool != nil {
+		b = pool.Get().(*Buffer)
+		b.pool = pool
+	} else {
+		b = &Buffer{buf: make([]byte, BUFFER_HEADROOM+size)}
+	}
+	b.head = BUFFER_HEADROOM
+	b.tail = BUFFER_HEADROOM
+	return b
+}
+
+// Release returns the buffer to the pool. The buffer and every packet that
+// refers to it must not be used afterwards.
+func (b *Buffer) Release() {
+	if b.pool != nil {
+		pool := b.pool
+		b.pool = nil
+		pool.Put(b)
+	}
+}
+
+// Bytes returns the data of the buffer.
+func (b *Buffer) Bytes() []byte {
+	return b.buf[b.head:b.tail]
+}
+
+func (b *Buffer) Len() int {
+	return b.tail - b.head
+}
+
+// Headroom returns the number of bytes that can be prepended.
+func (b *Buffer) Headroom() int {
+	return b.head
+}
+
+// Tailroom returns the number of bytes that can be appended.
+func (b *Buffer) Tailroom() int {
+	return len(b.buf) - b.tail
+}
+
+// Push prepends n bytes to the data and returns them. It panics if the
+// headroom is too small.
+func (b *Buffer) Push(n int) []byte {
+	if n > b.head {
+		panic("network: buffer headroom exhausted")
+	}
+	b.head -= n
+	return b.buf[b.head : b.head+n]
+}
+
+// Put appends n bytes to the data and returns them. It panics if the
+// tailroom is too small.
+func (b *Buffer) Put(n int) []byte {
+	if n > b.Tailroom() {
+		panic("network: buffer tailroom exhausted")
+	}
+	b.tail += n
+	return b.buf[b.tail-n : b.tail]
+}
+
+// Pull removes n bytes from the front of the data and returns them.
+func (b *Buffer) Pull(n int) []byte {
+	if n > b.Len() {
+		n = b.Len()
+	}
+	b.head += n
+	return b.buf[b.head-n : b.head]
+}
+
+// Trim shortens the data to n bytes.
+func (b *Buffer) Trim(n int) {
+	if n < b.Len() {
+		b.tail = b.head + n
+	}
+}
+
+// Packet returns a packet referring to the data of the buffer.
+func (b *Buffer) Packet() Packet {
+	return Packet{
+		Buf:    b.Bytes(),
+		N:      uintptr(b.Len()),
+		buffer: b,
+	}
+}
+
+// Release returns the buffer of the packet to the pool, if it has one. Only
+// the last holder of a packet may release it, and only once.
+func (p Packet) Release() {
+	if p.buffer != nil {
+		p.buffer.Release()
+	}
+}
+
+// Truncate returns the packet shortened to n bytes, for example to remove
+// link padding. The packet keeps its buffer.
+func (p Packet) Truncate(n uintptr) Packet {
+	if n >= p.N {
+		return p
+	}
+	if p.inPlace() {
+		p.buffer.Trim(int(n))
+	}
+	p.Buf = p.Buf[:n]
+	p.N = n
+	return p
+}
+
+// Report whether the packet data is exactly the data of its buffer, so the
+// buffer can be grown or shrunk in place.
+func (p Packet) inPlace() bool {
+	b := p.buffer
+	return b != nil && b.Len() > 0 && int(p.N) == b.Len() && &p.Buf[0] == &b.buf[b.head]
+}
+
+// Return the packet with n bytes prepended in the headroom of its buffer. It
+// reports false if the packet has no buffer or not enough headroom.
+func (p Packet) push(n int) (Packet, bool) {
+	if !p.inPlace() || p.buffer.Headroom() < n {
+		return Packet{}, false
+	}
+	p.buffer.Push(n)
+	pkt := p.buffer.Packet()
+	pkt.Protocol = p.Protocol
+	return pkt, true
+}
+
+// Return the packet without its first n bytes.
+func (p Packet) pull(n int) Packet {
+	if p.inPlace() {
+		p.buffer.Pull(n)
+		pkt := p.buffer.Packet()
+		pkt.Protocol = p.Protocol
+		return pkt
+	}
+	return Packet{
+		Buf:      p.Buf[n:p.N],
+		N:        p.N - uintptr(n),
+		Protocol: p.Protocol,
+		buffer:   p.buffer,
+	}
+}
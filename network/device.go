@@ -0,0 +1,33 @@
+package network
+
+// Device is a link-layer device that the internet layer reads packets from
+// and writes packets to.
+//
+// A packet has a single owner, which releases it once done with it. Read
+// hands the packet over to the caller. Write takes the packet over, even
+// when it returns an error, so the caller must not use it afterwards.
+type Device interface {
+	Read() (Packet, error)
+	Write(pkt Packet) error
+	Close() error
+	MTU() int
+	Stats() Stats
+}
+
+// GSODevice is implemented by devices that accept TCP packets larger than
+// the MTU and segment them on the way out, such as a NetDevice opened with
+// Offload.
+type GSODevice interface {
+	Device
+	// GSOMaxSize returns the largest TCP packet the device accepts.
+	GSOMaxSize() int
+}
+
+// GSOMaxSize returns the largest TCP packet the device accepts: its
+// GSOMaxSize if it is a GSODevice, otherwise its MTU.
+func GSOMaxSize(device Device) int {
+	if gso, ok := device.(GSODevice); ok {
+		return gso.GSOMaxSize()
+	}
+	return device.MTU()
+}
@@ -0,0 +1,290 @@
+package network
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"sync"
+)
+
+const (
+	ETHERNET_HEADER_LEN = 14
+	ETHER_TYPE_IPV4     = 0x0800
+	ETHER_TYPE_ARP      = 0x0806
+	ETHER_TYPE_IPV6     = 0x86DD
+)
+
+type HardwareAddr [6]byte
+
+var BroadcastHardwareAddr = HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+// Create a random, locally administered unicast hardware address.
+func NewHardwareAddr() (HardwareAddr, error) {
+	var addr HardwareAddr
+	_, err := rand.Read(addr[:])
+	if err != nil {
+		return HardwareAddr{}, fmt.Errorf("rand error: %s", err.Error())
+	}
+	addr[0] = (addr[0] | 0x02) & 0xfe
+	return addr, nil
+}
+
+func (a HardwareAddr) IsMulticast() bool {
+	return a[0]&0x01 == 0x01
+}
+
+func (a HardwareAddr) String() string {
+	return fmt.Sprintf("%02x:%02x:%02x:%02x:%02x:%02x", a[0], a[1], a[2], a[3], a[4], a[5])
+}
+
+type EthernetHeader struct {
+	DstMAC    HardwareAddr
+	SrcMAC    HardwareAddr
+	EtherType uint16
+}
+
+// Create a new Ethernet header from frame.
+func unmarshalEthernet(frame []byte) (*EthernetHeader, error) {
+	if len(frame) < ETHERNET_HEADER_LEN {
+		return nil, fmt.Errorf("invalid Ethernet header length")
+	}
+
+	header := &EthernetHeader{
+		EtherType: binary.BigEndian.Uint16(frame[12:14]),
+	}
+	copy(header.DstMAC[:], frame[0:6])
+	copy(header.SrcMAC[:], frame[6:12])
+
+	return header, nil
+}
+
+// Return a byte slice of the header.
+func (h *EthernetHeader) Marshal() []byte {
+	buf := make([]byte, ETHERNET_HEADER_LEN)
+	h.marshalTo(buf)
+	return buf
+}
+
+// Write the header into the first ETHERNET_HEADER_LEN bytes of buf.
+func (h *EthernetHeader) marshalTo(buf []byte) {
+	copy(buf[0:6], h.DstMAC[:])
+	copy(buf[6:12], h.SrcMAC[:])
+	binary.BigEndian.PutUint16(buf[12:14], h.EtherType)
+}
+
+// EthernetHandler receives frames of a registered EtherType. The packet
+// holds the frame payload without the Ethernet header.
+type EthernetHandler func(hdr *EthernetHeader, pkt Packet)
+
+// EthernetDevice adds Ethernet framing on top of a device that carries
+// frames, such as a TAP device. Read returns IPv4 payloads and hands other
+// EtherTypes to their registered handlers.
+type EthernetDevice struct {
+	device    Device
+	mac       HardwareAddr
+	addr      [4]byte
+	prefixLen int
+	gateway   [4]byte
+	handlers  map[uint16]EthernetHandler
+	neighbors *neighborCache
+	stats     counters
+	lock      sync.Mutex
+	ctx       context.Context
+	cancel    context.CancelFunc
+}
+
+func NewEthernet(device Device, mac HardwareAddr) *EthernetDevice {
+	e := &EthernetDevice{
+		device:   device,
+		mac:      mac,
+		handlers: make(map[uint16]EthernetHandler),
+	}
+	e.neighbors = newNeighborCache(&e.stats)
+	e.ctx, e.cancel = context.WithCancel(context.Background())
+	e.Handle(ETHER_TYPE_ARP, e.recvArp)
+	go e.ageNeighbors()
+
+	return e
+}
+
+// HardwareAddr returns the address frames are sent from.
+func (e *EthernetDevice) HardwareAddr() HardwareAddr {
+	return e.mac
+}
+
+// Handle registers a handler for frames of the given EtherType. The payload
+// is released when the handler returns, so it must be copied to be kept.
+func (e *EthernetDevice) Handle(etherType uint16, handler EthernetHandler) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.handlers[etherType] = handler
+}
+
+// SetAddress sets the IPv4 address and prefix length of the device. ARP
+// requests for the address are answered, and destinations outside the prefix
+// are sent to the gateway.
+func (e *EthernetDevice) SetAddress(addr [4]byte, prefixLen int) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.addr = addr
+	e.prefixLen = prefixLen
+}
+
+// SetGateway sets the next hop for destinations outside the local prefix.
+func (e *EthernetDevice) SetGateway(gateway [4]byte) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.gateway = gateway
+}
+
+// AddNeighbor adds a static neighbor entry that never ages out.
+func (e *EthernetDevice) AddNeighbor(ip [4]byte, mac HardwareAddr) {
+	pending := e.neighbors.resolve(ip, mac, true)
+	e.flush(mac, pending)
+}
+
+// Return the IPv4 address the packet to dst is handed to on this link.
+func (e *EthernetDevice) nextHop(dst [4]byte) [4]byte {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.gateway == [4]byte{} || e.prefixLen == 0 {
+		return dst
+	}
+	mask := ^uint32(0) << (32 - e.prefixLen)
+	if binary.BigEndian.Uint32(dst[:])&mask == binary.BigEndian.Uint32(e.addr[:])&mask {
+		return dst
+	}
+	return e.gateway
+}
+
+func (e *EthernetDevice) address() [4]byte {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.addr
+}
+
+func (e *EthernetDevice) handler(etherType uint16) (EthernetHandler, bool) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	handler, ok := e.handlers[etherType]
+	return handler, ok
+}
+
+func (e *EthernetDevice) Close() error {
+	e.cancel()
+	return e.device.Close()
+}
+
+func (e *EthernetDevice) MTU() int {
+	return e.device.MTU()
+}
+
+func (e *EthernetDevice) GSOMaxSize() int {
+	return GSOMaxSize(e.device)
+}
+
+func (e *EthernetDevice) Stats() Stats {
+	return e.stats.snapshot()
+}
+
+func (e *EthernetDevice) Read() (Packet, error) {
+	for {
+		frame, err := e.device.Read()
+		if err != nil {
+			return Packet{}, err
+		}
+
+		e.stats.received(frame)
+
+		hdr, err := unmarshalEthernet(frame.Buf[:frame.N])
+		if err != nil {
+			frame.Release()
+			e.stats.rxErrors.Add(1)
+			log.Printf("unmarshal error: %s", err)
+			continue
+		}
+		if hdr.DstMAC != e.mac && !hdr.DstMAC.IsMulticast() {
+			frame.Release()
+			e.stats.rxDropped.Add(1)
+			continue
+		}
+
+		pkt := frame.pull(ETHERNET_HEADER_LEN)
+		pkt.Protocol = hdr.EtherType
+		if hdr.EtherType == ETHER_TYPE_IPV4 {
+			return pkt, nil
+		}
+		handler, ok := e.handler(hdr.EtherType)
+		if !ok {
+			pkt.Release()
+			e.stats.rxDropped.Add(1)
+			continue
+		}
+		handler(hdr, pkt)
+		pkt.Release()
+	}
+}
+
+// Write sends an IPv4 packet to the hardware address of its next hop,
+// resolving the address with ARP first if it is not cached.
+func (e *EthernetDevice) Write(pkt Packet) error {
+	if pkt.N < 20 {
+		pkt.Release()
+		e.stats.txErrors.Add(1)
+		return fmt.Errorf("invalid IPv4 packet length")
+	}
+	var srcIP, dstIP [4]byte
+	copy(srcIP[:], pkt.Buf[12:16])
+	copy(dstIP[:], pkt.Buf[16:20])
+
+	nextHop := e.nextHop(dstIP)
+	if nextHop == [4]byte{255, 255, 255, 255} {
+		return e.WriteFrame(BroadcastHardwareAddr, ETHER_TYPE_IPV4, pkt)
+	}
+
+	dstMAC, ok, request := e.neighbors.lookup(nextHop, pkt)
+	if request {
+		err := e.sendArpRequest(srcIP, nextHop)
+		if err != nil {
+			return err
+		}
+	}
+	if !ok {
+		return nil
+	}
+
+	return e.WriteFrame(dstMAC, ETHER_TYPE_IPV4, pkt)
+}
+
+// WriteFrame sends the payload in an Ethernet frame to dst. The header is
+// written in the headroom of the packet's buffer if it has enough.
+func (e *EthernetDevice) WriteFrame(dst HardwareAddr, etherType uint16, pkt Packet) error {
+	hdr := EthernetHeader{
+		DstMAC:    dst,
+		SrcMAC:    e.mac,
+		EtherType: etherType,
+	}
+	framePkt, ok := pkt.push(ETHERNET_HEADER_LEN)
+	if !ok {
+		frame := make([]byte, ETHERNET_HEADER_LEN+pkt.N)
+		copy(frame[ETHERNET_HEADER_LEN:], pkt.Buf[:pkt.N])
+		framePkt = Packet{
+			Buf: frame,
+			N:   uintptr(len(frame)),
+		}
+		pkt.Release()
+	}
+	framePkt.Protocol = etherType
+	hdr.marshalTo(framePkt.Buf)
+
+	err := e.device.Write(framePkt)
+	if err != nil {
+		e.stats.txErrors.Add(1)
+		return err
+	}
+	e.stats.sent(framePkt)
+	return nil
+}
@@ -0,0 +1,212 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// FaultOptions configures the impairments of a FaultDevice. Each rate is the
+// probability, from 0 to 1, that the impairment is applied to a packet.
+type FaultOptions struct {
+	// Seed of the random number generator. Runs with the same seed and the
+	// same traffic make the same decisions.
+	Seed int64
+	// Drop the packet.
+	LossRate float64
+	// Deliver the packet twice.
+	DuplicateRate float64
+	// Hold the packet back and deliver it after the next one.
+	ReorderRate float64
+	// Flip one random bit of the packet.
+	CorruptRate float64
+	// Deliver the packet after Delay.
+	DelayRate float64
+	Delay     time.Duration
+}
+
+// faultDirection holds the impairment state of one direction of the link.
+type faultDirection struct {
+	rand    *rand.Rand
+	held    *Packet
+	emit    func(Packet)
+	dropped *atomic.Uint64
+	lock    sync.Mutex
+}
+
+// FaultDevice wraps a device and impairs the packets passing through it in
+// both directions.
+type FaultDevice struct {
+	device        Device
+	opts          FaultOptions
+	incoming      *faultDirection
+	outgoing      *faultDirection
+	incomingQueue chan Packet
+	readDone      chan struct{}
+	err           error
+	stats         counters
+	ctx           context.Context
+	cancel        context.CancelFunc
+}
+
+func NewFault(device Device, opts FaultOptions) *FaultDevice {
+	f := &FaultDevice{
+		device:        device,
+		opts:          opts,
+		incomingQueue: make(chan Packet, QUEUE_SIZE),
+		readDone:      make(chan struct{}),
+	}
+	f.ctx, f.cancel = context.WithCancel(context.Background())
+	f.incoming = &faultDirection{
+		rand:    rand.New(rand.NewSource(opts.Seed)),
+		emit:    f.enqueue,
+		dropped: &f.stats.rxDropped,
+	}
+	f.outgoing = &faultDirection{
+		rand: rand.New(rand.NewSource(opts.Seed + 1)),
+		emit: func(pkt Packet) {
+			err := f.device.Write(pkt)
+			if err != nil {
+				f.stats.txErrors.Add(1)
+				log.Printf("write error: %s", err.Error())
+				return
+			}
+			f.stats.sent(pkt)
+		},
+		dropped: &f.stats.txDropped,
+	}
+
+	go f.readLoop()
+
+	return f
+}
+
+// Read packets from the underlying device and impair them. The incoming
+// queue is never closed, since delayed packets may still be queued after
+// the loop ends; readDone tells Read to return f.err instead.
+func (f *FaultDevice) readLoop() {
+	defer close(f.readDone)
+
+	for {
+		pkt, err := f.device.Read()
+		if err != nil {
+			f.err = err
+			return
+		}
+		f.impair(f.incoming, pkt)
+	}
+}
+
+func (f *FaultDevice) enqueue(pkt Packet) {
+	if !f.stats.enqueue(f.incomingQueue, pkt, f.ctx.Done()) {
+		pkt.Release()
+		return
+	}
+	f.stats.received(pkt)
+}
+
+// Apply the impairments to the packet and emit what is left of it. Every
+// packet draws the same number of random values, so the decisions only
+// depend on the seed and the order of the packets.
+func (f *FaultDevice) impair(dir *faultDirection, pkt Packet) {
+	dir.lock.Lock()
+	loss := dir.rand.Float64()
+	corrupt := dir.rand.Float64()
+	bit := dir.rand.Int()
+	duplicate := dir.rand.Float64()
+	reorder := dir.rand.Float64()
+	delay := dir.rand.Float64()
+
+	if loss < f.opts.LossRate {
+		dir.lock.Unlock()
+		pkt.Release()
+		dir.dropped.Add(1)
+		return
+	}
+	if corrupt < f.opts.CorruptRate && pkt.N > 0 {
+		buf := make([]byte, pkt.N)
+		copy(buf, pkt.Buf[:pkt.N])
+		bit %= 8 * int(pkt.N)
+		buf[bit/8] ^= 1 << (bit % 8)
+		pkt.Release()
+		pkt = Packet{Buf: buf, N: pkt.N, Protocol: pkt.Protocol}
+	}
+	if reorder < f.opts.ReorderRate && dir.held == nil {
+		dir.held = &pkt
+		dir.lock.Unlock()
+		return
+	}
+
+	pkts := []Packet{pkt}
+	if duplicate < f.opts.DuplicateRate {
+		// The copy does not share the buffer, so both can be released.
+		buf := make([]byte, pkt.N)
+		copy(buf, pkt.Buf[:pkt.N])
+		pkts = append(pkts, Packet{Buf: buf, N: pkt.N, Protocol: pkt.Protocol})
+	}
+	if dir.held != nil {
+		pkts = append(pkts, *dir.held)
+		dir.held = nil
+	}
+	dir.lock.Unlock()
+
+	if delay < f.opts.DelayRate && f.opts.Delay > 0 {
+		time.AfterFunc(f.opts.Delay, func() {
+			for _, p := range pkts {
+				dir.emit(p)
+			}
+		})
+		return
+	}
+	for _, p := range pkts {
+		dir.emit(p)
+	}
+}
+
+func (f *FaultDevice) Close() error {
+	f.cancel()
+	return f.device.Close()
+}
+
+func (f *FaultDevice) MTU() int {
+	return f.device.MTU()
+}
+
+func (f *FaultDevice) GSOMaxSize() int {
+	return GSOMaxSize(f.device)
+}
+
+func (f *FaultDevice) Stats() Stats {
+	return f.stats.snapshot()
+}
+
+func (f *FaultDevice) Read() (Packet, error) {
+	select {
+	case pkt := <-f.incomingQueue:
+		return pkt, nil
+	case <-f.readDone:
+		select {
+		case pkt := <-f.incomingQueue:
+			return pkt, nil
+		default:
+		}
+		return Packet{}, f.err
+	case <-f.ctx.Done():
+		return Packet{}, fmt.Errorf("device closed")
+	}
+}
+
+func (f *FaultDevice) Write(pkt Packet) error {
+	select {
+	case <-f.ctx.Done():
+		pkt.Release()
+		return fmt.Errorf("device closed")
+	default:
+	}
+	f.impair(f.outgoing, pkt)
+	return nil
+}
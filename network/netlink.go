@@ -0,0 +1,116 @@
+package network
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+type netlinkRequest struct {
+	buf []byte
+}
+
+// Create a new rtnetlink request with the given message type and body.
+func newNetlinkRequest(msgType uint16, flags uint16, body []byte) *netlinkRequest {
+	buf := make([]byte, syscall.SizeofNlMsghdr, syscall.SizeofNlMsghdr+len(body))
+	hdr := (*syscall.NlMsghdr)(unsafe.Pointer(&buf[0]))
+	hdr.Type = msgType
+	hdr.Flags = syscall.NLM_F_REQUEST | syscall.NLM_F_ACK | flags
+	hdr.Seq = 1
+
+	return &netlinkRequest{buf: append(buf, body...)}
+}
+
+// Append a route attribute to the request.
+func (r *netlinkRequest) addAttr(attrType uint16, data []byte) {
+	attr := make([]byte, rtaAlign(syscall.SizeofRtAttr+len(data)))
+	rta := (*syscall.RtAttr)(unsafe.Pointer(&attr[0]))
+	rta.Len = uint16(syscall.SizeofRtAttr + len(data))
+	rta.Type = attrType
+	copy(attr[syscall.SizeofRtAttr:], data)
+
+	r.buf = append(r.buf, attr...)
+}
+
+// Send the request to the kernel and wait for its acknowledgement.
+func (r *netlinkRequest) execute() error {
+	hdr := (*syscall.NlMsghdr)(unsafe.Pointer(&r.buf[0]))
+	hdr.Len = uint32(len(r.buf))
+
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return fmt.Errorf("netlink socket error: %s", err.Error())
+	}
+	defer syscall.Close(fd)
+
+	addr := &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}
+	if err := syscall.Sendto(fd, r.buf, 0, addr); err != nil {
+		return fmt.Errorf("netlink send error: %s", err.Error())
+	}
+
+	buf := make([]byte, syscall.Getpagesize())
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return fmt.Errorf("netlink recv error: %s", err.Error())
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return fmt.Errorf("netlink parse error: %s", err.Error())
+		}
+		for _, msg := range msgs {
+			if msg.Header.Seq != hdr.Seq || msg.Header.Type != syscall.NLMSG_ERROR {
+				continue
+			}
+			nlErr := (*syscall.NlMsgerr)(unsafe.Pointer(&msg.Data[0]))
+			if nlErr.Error != 0 {
+				return fmt.Errorf("netlink error: %s", syscall.Errno(-nlErr.Error).Error())
+			}
+			return nil
+		}
+	}
+}
+
+// Bring the link up and optionally set its MTU.
+func setLinkUp(index int, mtu int) error {
+	body := make([]byte, syscall.SizeofIfInfomsg)
+	ifi := (*syscall.IfInfomsg)(unsafe.Pointer(&body[0]))
+	ifi.Family = syscall.AF_UNSPEC
+	ifi.Index = int32(index)
+	ifi.Flags = syscall.IFF_UP
+	ifi.Change = syscall.IFF_UP
+
+	req := newNetlinkRequest(syscall.RTM_NEWLINK, 0, body)
+	if mtu > 0 {
+		data := make([]byte, 4)
+		*(*uint32)(unsafe.Pointer(&data[0])) = uint32(mtu)
+		req.addAttr(syscall.IFLA_MTU, data)
+	}
+
+	return req.execute()
+}
+
+// Assign an IPv4 address to the link. If peer is set, the link is configured
+// as a point-to-point link to the peer.
+func addAddress(index int, local, peer [4]byte, prefixLen int) error {
+	body := make([]byte, syscall.SizeofIfAddrmsg)
+	ifa := (*syscall.IfAddrmsg)(unsafe.Pointer(&body[0]))
+	ifa.Family = syscall.AF_INET
+	ifa.Prefixlen = uint8(prefixLen)
+	ifa.Index = uint32(index)
+
+	address := local
+	if peer != [4]byte{} {
+		address = peer
+	}
+
+	req := newNetlinkRequest(syscall.RTM_NEWADDR, syscall.NLM_F_CREATE|syscall.NLM_F_REPLACE, body)
+	req.addAttr(syscall.IFA_LOCAL, local[:])
+	req.addAttr(syscall.IFA_ADDRESS, address[:])
+
+	return req.execute()
+}
+
+func rtaAlign(n int) int {
+	return (n + syscall.RTA_ALIGNTO - 1) & ^(syscall.RTA_ALIGNTO - 1)
+}
@@ -0,0 +1,178 @@
+package network
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	LINKTYPE_ETHERNET = 1
+	LINKTYPE_RAW      = 101
+	PCAP_SNAPLEN      = 65535
+
+	pcapngSectionHeaderBlock  = 0x0A0D0D0A
+	pcapngInterfaceBlock      = 0x00000001
+	pcapngEnhancedPacketBlock = 0x00000006
+	pcapngByteOrderMagic      = 0x1A2B3C4D
+	pcapngOptEndOfOpt         = 0
+	pcapngOptTsResol          = 9
+	pcapngOptEpbFlags         = 2
+	pcapngTsResolNanosecond   = 9
+	pcapngDirectionInbound    = 1
+	pcapngDirectionOutbound   = 2
+)
+
+// PcapDevice records every packet read from or written to the underlying
+// device in pcapng format, which libpcap and Wireshark read natively.
+// Each record carries a nanosecond timestamp and its direction.
+type PcapDevice struct {
+	device Device
+	w      io.Writer
+	closer io.Closer
+	lock   sync.Mutex
+}
+
+// Create a device that writes a capture of device to w. The link type is
+// LINKTYPE_RAW for TUN devices and LINKTYPE_ETHERNET for TAP devices.
+func NewPcap(device Device, w io.Writer, linkType uint16) (*PcapDevice, error) {
+	p := &PcapDevice{
+		device: device,
+		w:      w,
+	}
+	err := p.writeHeader(linkType)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Create a device that writes a capture of device to the file at path.
+// The file is closed when the device is closed.
+func NewPcapFile(device Device, path string, linkType uint16) (*PcapDevice, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("create error: %s", err.Error())
+	}
+	p, err := NewPcap(device, file, linkType)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	p.closer = file
+	return p, nil
+}
+
+// Write the section header and interface description blocks.
+func (p *PcapDevice) writeHeader(linkType uint16) error {
+	shb := make([]byte, 28)
+	binary.LittleEndian.PutUint32(shb[0:4], pcapngSectionHeaderBlock)
+	binary.LittleEndian.PutUint32(shb[4:8], uint32(len(shb)))
+	binary.LittleEndian.PutUint32(shb[8:12], pcapngByteOrderMagic)
+	binary.LittleEndian.PutUint16(shb[12:14], 1)
+	binary.LittleEndian.PutUint16(shb[14:16], 0)
+	binary.LittleEndian.PutUint64(shb[16:24], 0xFFFFFFFFFFFFFFFF)
+	binary.LittleEndian.PutUint32(shb[24:28], uint32(len(shb)))
+
+	idb := make([]byte, 32)
+	binary.LittleEndian.PutUint32(idb[0:4], pcapngInterfaceBlock)
+	binary.LittleEndian.PutUint32(idb[4:8], uint32(len(idb)))
+	binary.LittleEndian.PutUint16(idb[8:10], linkType)
+	binary.LittleEndian.PutUint32(idb[12:16], PCAP_SNAPLEN)
+	binary.LittleEndian.PutUint16(idb[16:18], pcapngOptTsResol)
+	binary.LittleEndian.PutUint16(idb[18:20], 1)
+	idb[20] = pcapngTsResolNanosecond
+	binary.LittleEndian.PutUint16(idb[24:26], pcapngOptEndOfOpt)
+	binary.LittleEndian.PutUint32(idb[28:32], uint32(len(idb)))
+
+	_, err := p.w.Write(append(shb, idb...))
+	if err != nil {
+		return fmt.Errorf("pcap write error: %s", err.Error())
+	}
+	return nil
+}
+
+// Write an enhanced packet block for the packet.
+func (p *PcapDevice) record(pkt Packet, direction uint32) error {
+	ts := uint64(time.Now().UnixNano())
+	data := pkt.Buf[:pkt.N]
+	if len(data) > PCAP_SNAPLEN {
+		data = data[:PCAP_SNAPLEN]
+	}
+	padded := (len(data) + 3) &^ 3
+
+	blockLen := 28 + padded + 12 + 4
+	block := make([]byte, blockLen)
+	binary.LittleEndian.PutUint32(block[0:4], pcapngEnhancedPacketBlock)
+	binary.LittleEndian.PutUint32(block[4:8], uint32(blockLen))
+	binary.LittleEndian.PutUint32(block[8:12], 0)
+	binary.LittleEndian.PutUint32(block[12:16], uint32(ts>>32))
+	binary.LittleEndian.PutUint32(block[16:20], uint32(ts))
+	binary.LittleEndian.PutUint32(block[20:24], uint32(len(data)))
+	binary.LittleEndian.PutUint32(block[24:28], uint32(pkt.N))
+	copy(block[28:], data)
+
+	opts := block[28+padded:]
+	binary.LittleEndian.PutUint16(opts[0:2], pcapngOptEpbFlags)
+	binary.LittleEndian.PutUint16(opts[2:4], 4)
+	binary.LittleEndian.PutUint32(opts[4:8], direction)
+	binary.LittleEndian.PutUint16(opts[8:10], pcapngOptEndOfOpt)
+	binary.LittleEndian.PutUint32(block[blockLen-4:], uint32(blockLen))
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	_, err := p.w.Write(block)
+	if err != nil {
+		return fmt.Errorf("pcap write error: %s", err.Error())
+	}
+	return nil
+}
+
+func (p *PcapDevice) Close() error {
+	err := p.device.Close()
+	if p.closer != nil {
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		if cerr := p.closer.Close(); cerr != nil && err == nil {
+			err = fmt.Errorf("close error: %s", cerr.Error())
+		}
+	}
+	return err
+}
+
+func (p *PcapDevice) MTU() int {
+	return p.device.MTU()
+}
+
+func (p *PcapDevice) GSOMaxSize() int {
+	return GSOMaxSize(p.device)
+}
+
+// Stats returns the counters of the captured device.
+func (p *PcapDevice) Stats() Stats {
+	return p.device.Stats()
+}
+
+func (p *PcapDevice) Read() (Packet, error) {
+	pkt, err := p.device.Read()
+	if err != nil {
+		return Packet{}, err
+	}
+	err = p.record(pkt, pcapngDirectionInbound)
+	if err != nil {
+		log.Printf("%s", err.Error())
+	}
+	return pkt, nil
+}
+
+func (p *PcapDevice) Write(pkt Packet) error {
+	err := p.record(pkt, pcapngDirectionOutbound)
+	if err != nil {
+		log.Printf("%s", err.Error())
+	}
+	return p.device.Write(pkt)
+}
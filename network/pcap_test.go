@@ -0,0 +1,93 @@
+package network
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPcapReplayRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		linkType uint16
+		inbound  [][]byte
+		outbound [][]byte
+	}{
+		{
+			name:     "raw",
+			linkType: LINKTYPE_RAW,
+			inbound:  [][]byte{{0x45, 0, 0, 20}, bytes.Repeat([]byte{0xAB}, 1500)},
+			outbound: [][]byte{{0x45, 1, 2, 3}},
+		},
+		{
+			name:     "ethernet",
+			linkType: LINKTYPE_ETHERNET,
+			// Lengths that need padding to 4 bytes in pcapng.
+			inbound: [][]byte{bytes.Repeat([]byte{1}, 61), bytes.Repeat([]byte{2}, 62), bytes.Repeat([]byte{3}, 63)},
+		},
+		{
+			name:     "empty",
+			linkType: LINKTYPE_RAW,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			local, peer := NewPipe()
+			var capture bytes.Buffer
+			pcap, err := NewPcap(local, &capture, tt.linkType)
+			if err != nil {
+				t.Fatalf("NewPcap: %s", err)
+			}
+
+			for _, data := range tt.inbound {
+				err := peer.Write(Packet{Buf: data, N: uintptr(len(data))})
+				if err != nil {
+					t.Fatalf("Write: %s", err)
+				}
+				pkt, err := pcap.Read()
+				if err != nil {
+					t.Fatalf("Read: %s", err)
+				}
+				pkt.Release()
+			}
+			for _, data := range tt.outbound {
+				err := pcap.Write(Packet{Buf: data, N: uintptr(len(data))})
+				if err != nil {
+					t.Fatalf("Write: %s", err)
+				}
+				pkt, err := peer.Read()
+				if err != nil {
+					t.Fatalf("Read: %s", err)
+				}
+				pkt.Release()
+			}
+			pcap.Close()
+
+			replay, err := NewPcapReplay(&capture)
+			if err != nil {
+				t.Fatalf("NewPcapReplay: %s", err)
+			}
+			defer replay.Close()
+			if replay.LinkType() != tt.linkType {
+				t.Errorf("LinkType = %d, want %d", replay.LinkType(), tt.linkType)
+			}
+
+			// Outbound packets are skipped, so only the inbound ones come
+			// back.
+			for i, data := range tt.inbound {
+				pkt, err := replay.Read()
+				if err != nil {
+					t.Fatalf("packet %d: Read: %s", i, err)
+				}
+				if !bytes.Equal(pkt.Buf[:pkt.N], data) {
+					t.Errorf("packet %d = % x, want % x", i, pkt.Buf[:pkt.N], data)
+				}
+			}
+			select {
+			case <-replay.Replayed():
+			default:
+				t.Errorf("capture holds more packets than were read")
+			}
+		})
+	}
+}
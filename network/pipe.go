@@ -0,0 +1,86 @@
+package network
+
+import (
+	"fmt"
+	"sync"
+)
+
+// PipeDevice is one end of an in-memory link created by NewPipe.
+type PipeDevice struct {
+	incomingQueue chan Packet
+	outgoingQueue chan Packet
+	mtu           int
+	stats         counters
+	done          chan struct{}
+	closeOnce     *sync.Once
+}
+
+// Create two linked devices. Packets written to one are read from the other.
+func NewPipe() (*PipeDevice, *PipeDevice) {
+	a := make(chan Packet, QUEUE_SIZE)
+	b := make(chan Packet, QUEUE_SIZE)
+	done := make(chan struct{})
+	once := &sync.Once{}
+
+	left := &PipeDevice{
+		incomingQueue: a,
+		outgoingQueue: b,
+		mtu:           MTU,
+		done:          done,
+		closeOnce:     once,
+	}
+	right := &PipeDevice{
+		incomingQueue: b,
+		outgoingQueue: a,
+		mtu:           MTU,
+		done:          done,
+		closeOnce:     once,
+	}
+
+	return left, right
+}
+
+// Close closes both ends of the pipe.
+func (p *PipeDevice) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.done)
+	})
+	return nil
+}
+
+func (p *PipeDevice) MTU() int {
+	return p.mtu
+}
+
+func (p *PipeDevice) Stats() Stats {
+	return p.stats.snapshot()
+}
+
+func (p *PipeDevice) Read() (Packet, error) {
+	select {
+	case pkt := <-p.incomingQueue:
+		p.stats.received(pkt)
+		return pkt, nil
+	case <-p.done:
+		return Packet{}, fmt.Errorf("device closed")
+	}
+}
+
+func (p *PipeDevice) Write(pkt Packet) error {
+	buf := make([]byte, pkt.N)
+	copy(buf, pkt.Buf[:pkt.N])
+	pkt.Release()
+
+	select {
+	case <-p.done:
+		p.stats.txDropped.Add(1)
+		return fmt.Errorf("device closed")
+	default:
+	}
+	if !p.stats.enqueue(p.outgoingQueue, Packet{Buf: buf, N: pkt.N, Protocol: pkt.Protocol}, p.done) {
+		p.stats.txDropped.Add(1)
+		return fmt.Errorf("device closed")
+	}
+	p.stats.sent(pkt)
+	return nil
+}
@@ -0,0 +1,306 @@
+package network
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+const (
+	pcapMagicMicrosecond    = 0xA1B2C3D4
+	pcapMagicNanosecond     = 0xA1B23C4D
+	pcapngSimplePacketBlock = 0x00000003
+)
+
+// ReplayDevice feeds the packets of a pcap or pcapng capture into the stack
+// as incoming traffic, as fast as they are read. Packets written to the
+// device are collected instead of being sent anywhere.
+type ReplayDevice struct {
+	packets  []Packet
+	linkType uint16
+	next     int
+	filter   func(Packet) bool
+	written  []Packet
+	replayed chan struct{}
+	done     chan struct{}
+	stats    counters
+	lock     sync.Mutex
+	once     sync.Once
+}
+
+// Create a device that replays the capture read from r. In pcapng captures,
+// packets recorded as outbound are skipped.
+func NewPcapReplay(r io.Reader) (*ReplayDevice, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(4)
+	if err != nil {
+		return nil, fmt.Errorf("pcap read error: %s", err.Error())
+	}
+
+	var packets []Packet
+	var linkType uint16
+	if binary.LittleEndian.Uint32(magic) == pcapngSectionHeaderBlock {
+		packets, linkType, err = readPcapng(br)
+	} else {
+		packets, linkType, err = readPcap(br)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	d := &ReplayDevice{
+		packets:  packets,
+		linkType: linkType,
+		written:  make([]Packet, 0),
+		replayed: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if len(packets) == 0 {
+		close(d.replayed)
+	}
+	return d, nil
+}
+
+// Create a device that replays the capture in the file at path.
+func OpenPcapReplay(path string) (*ReplayDevice, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open error: %s", err.Error())
+	}
+	defer file.Close()
+
+	return NewPcapReplay(file)
+}
+
+// Read packets from a classic libpcap capture.
+func readPcap(r io.Reader) ([]Packet, uint16, error) {
+	hdr := make([]byte, 24)
+	_, err := io.ReadFull(r, hdr)
+	if err != nil {
+		return nil, 0, fmt.Errorf("pcap read error: %s", err.Error())
+	}
+
+	var order binary.ByteOrder
+	switch {
+	case binary.LittleEndian.Uint32(hdr[0:4]) == pcapMagicMicrosecond,
+		binary.LittleEndian.Uint32(hdr[0:4]) == pcapMagicNanosecond:
+		order = binary.LittleEndian
+	case binary.BigEndian.Uint32(hdr[0:4]) == pcapMagicMicrosecond,
+		binary.BigEndian.Uint32(hdr[0:4]) == pcapMagicNanosecond:
+		order = binary.BigEndian
+	default:
+		return nil, 0, fmt.Errorf("unknown capture format")
+	}
+	linkType := uint16(order.Uint32(hdr[20:24]))
+
+	packets := make([]Packet, 0)
+	rec := make([]byte, 16)
+	for {
+		_, err := io.ReadFull(r, rec)
+		if err == io.EOF {
+			return packets, linkType, nil
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("pcap read error: %s", err.Error())
+		}
+
+		capLen := order.Uint32(rec[8:12])
+		if capLen > PCAP_SNAPLEN {
+			return nil, 0, fmt.Errorf("invalid pcap record length: %d", capLen)
+		}
+		buf := make([]byte, capLen)
+		_, err = io.ReadFull(r, buf)
+		if err != nil {
+			return nil, 0, fmt.Errorf("pcap read error: %s", err.Error())
+		}
+		packets = append(packets, Packet{Buf: buf, N: uintptr(capLen)})
+	}
+}
+
+// Read packets from a pcapng capture. Only the first interface is replayed.
+func readPcapng(r io.Reader) ([]Packet, uint16, error) {
+	var order binary.ByteOrder = binary.LittleEndian
+	var linkType uint16
+	interfaces := 0
+
+	packets := make([]Packet, 0)
+	hdr := make([]byte, 8)
+	for {
+		_, err := io.ReadFull(r, hdr)
+		if err == io.EOF {
+			return packets, linkType, nil
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("pcapng read error: %s", err.Error())
+		}
+
+		blockType := order.Uint32(hdr[0:4])
+		if blockType == pcapngSectionHeaderBlock {
+			bom := make([]byte, 4)
+			_, err := io.ReadFull(r, bom)
+			if err != nil {
+				return nil, 0, fmt.Errorf("pcapng read error: %s", err.Error())
+			}
+			if binary.BigEndian.Uint32(bom) == pcapngByteOrderMagic {
+				order = binary.BigEndian
+			} else {
+				order = binary.LittleEndian
+			}
+			interfaces = 0
+			hdr = append(hdr, bom...)
+		}
+
+		blockLen := order.Uint32(hdr[4:8])
+		if blockLen < uint32(len(hdr))+4 || blockLen%4 != 0 || blockLen > 16*PCAP_SNAPLEN {
+			return nil, 0, fmt.Errorf("invalid pcapng block length: %d", blockLen)
+		}
+		body := make([]byte, blockLen-uint32(len(hdr)))
+		_, err = io.ReadFull(r, body)
+		if err != nil {
+			return nil, 0, fmt.Errorf("pcapng read error: %s", err.Error())
+		}
+		body = body[:len(body)-4]
+		hdr = hdr[:8]
+
+		switch blockType {
+		case pcapngInterfaceBlock:
+			if len(body) < 8 {
+				return nil, 0, fmt.Errorf("invalid pcapng interface block")
+			}
+			if interfaces == 0 {
+				linkType = order.Uint16(body[0:2])
+			}
+			interfaces++
+		case pcapngEnhancedPacketBlock:
+			if len(body) < 20 {
+				return nil, 0, fmt.Errorf("invalid pcapng packet block")
+			}
+			capLen := order.Uint32(body[12:16])
+			if order.Uint32(body[0:4]) != 0 || uint32(len(body)-20) < capLen {
+				continue
+			}
+			opts := body[len(body):]
+			if padded := 20 + (capLen+3)&^3; padded <= uint32(len(body)) {
+				opts = body[padded:]
+			}
+			if pcapngDirection(opts, order) == pcapngDirectionOutbound {
+				continue
+			}
+			buf := make([]byte, capLen)
+			copy(buf, body[20:20+capLen])
+			packets = append(packets, Packet{Buf: buf, N: uintptr(capLen)})
+		case pcapngSimplePacketBlock:
+			if len(body) < 4 {
+				return nil, 0, fmt.Errorf("invalid pcapng packet block")
+			}
+			buf := make([]byte, len(body)-4)
+			copy(buf, body[4:])
+			if origLen := order.Uint32(body[0:4]); origLen < uint32(len(buf)) {
+				buf = buf[:origLen]
+			}
+			packets = append(packets, Packet{Buf: buf, N: uintptr(len(buf))})
+		}
+	}
+}
+
+// Return the direction recorded in the epb_flags option, or 0 if unknown.
+func pcapngDirection(opts []byte, order binary.ByteOrder) uint32 {
+	for len(opts) >= 4 {
+		code := order.Uint16(opts[0:2])
+		length := int(order.Uint16(opts[2:4]))
+		if code == pcapngOptEndOfOpt || len(opts) < 4+length {
+			return 0
+		}
+		if code == pcapngOptEpbFlags && length == 4 {
+			return order.Uint32(opts[4:8]) & 0x3
+		}
+		opts = opts[4+((length+3)&^3):]
+	}
+	return 0
+}
+
+// LinkType returns the pcap link type of the capture.
+func (d *ReplayDevice) LinkType() uint16 {
+	return d.linkType
+}
+
+// Filter sets a function that selects which captured packets are replayed.
+func (d *ReplayDevice) Filter(filter func(Packet) bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.filter = filter
+}
+
+// Replayed returns a channel that is closed once every packet has been read.
+func (d *ReplayDevice) Replayed() <-chan struct{} {
+	return d.replayed
+}
+
+// Written returns the packets written to the device so far.
+func (d *ReplayDevice) Written() []Packet {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	written := make([]Packet, len(d.written))
+	copy(written, d.written)
+	return written
+}
+
+func (d *ReplayDevice) Close() error {
+	d.once.Do(func() {
+		close(d.done)
+	})
+	return nil
+}
+
+func (d *ReplayDevice) MTU() int {
+	return MTU
+}
+
+func (d *ReplayDevice) Stats() Stats {
+	return d.stats.snapshot()
+}
+
+// Read returns the next captured packet. Once the capture is exhausted, it
+// blocks until the device is closed.
+func (d *ReplayDevice) Read() (Packet, error) {
+	d.lock.Lock()
+	for d.next < len(d.packets) {
+		pkt := d.packets[d.next]
+		d.next++
+		if d.next == len(d.packets) {
+			close(d.replayed)
+		}
+		if d.filter == nil || d.filter(pkt) {
+			d.lock.Unlock()
+			d.stats.received(pkt)
+			return pkt, nil
+		}
+		d.stats.rxDropped.Add(1)
+	}
+	d.lock.Unlock()
+
+	<-d.done
+	return Packet{}, fmt.Errorf("device closed")
+}
+
+func (d *ReplayDevice) Write(pkt Packet) error {
+	select {
+	case <-d.done:
+		pkt.Release()
+		return fmt.Errorf("device closed")
+	default:
+	}
+
+	buf := make([]byte, pkt.N)
+	copy(buf, pkt.Buf[:pkt.N])
+	pkt.Release()
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.written = append(d.written, Packet{Buf: buf, N: pkt.N})
+	d.stats.sent(pkt)
+	return nil
+}
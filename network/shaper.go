@@ -0,0 +1,263 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// ShaperOptions configures each direction of a ShapedDevice.
+type ShaperOptions struct {
+	// Bottleneck rate in bits per second. Zero means unlimited.
+	Rate int64
+	// One-way propagation delay.
+	Delay time.Duration
+	// Maximum number of bytes waiting for transmission. Packets that do not
+	// fit are dropped. Zero means unlimited.
+	QueueBytes int
+}
+
+type shapedPacket struct {
+	pkt     Packet
+	deliver time.Time
+}
+
+// shaperQueue emulates one direction of a link: a byte-limited FIFO drained
+// at the bottleneck rate, followed by the propagation delay.
+type shaperQueue struct {
+	opts     ShaperOptions
+	emit     func(Packet)
+	queue    []Packet
+	queued   int
+	inFlight []shapedPacket
+	queueCh  chan struct{}
+	flightCh chan struct{}
+	lock     sync.Mutex
+	ctx      context.Context
+}
+
+func newShaperQueue(ctx context.Context, opts ShaperOptions, emit func(Packet)) *shaperQueue {
+	q := &shaperQueue{
+		opts:     opts,
+		emit:     emit,
+		queueCh:  make(chan struct{}, 1),
+		flightCh: make(chan struct{}, 1),
+		ctx:      ctx,
+	}
+	go q.transmit()
+	go q.propagate()
+	return q
+}
+
+// Add the packet to the tail of the queue. It reports false if the packet
+// was dropped because the queue is full.
+func (q *shaperQueue) enqueue(pkt Packet) bool {
+	q.lock.Lock()
+	if q.opts.QueueBytes > 0 && q.queued+int(pkt.N) > q.opts.QueueBytes {
+		q.lock.Unlock()
+		return false
+	}
+	q.queue = append(q.queue, pkt)
+	q.queued += int(pkt.N)
+	q.lock.Unlock()
+
+	notify(q.queueCh)
+	return true
+}
+
+// Serialize the queued packets onto the link at the configured rate.
+func (q *shaperQueue) transmit() {
+	var departure time.Time
+	for {
+		q.lock.Lock()
+		if len(q.queue) == 0 {
+			q.lock.Unlock()
+			select {
+			case <-q.ctx.Done():
+				return
+			case <-q.queueCh:
+				continue
+			}
+		}
+		pkt := q.queue[0]
+		q.lock.Unlock()
+
+		now := time.Now()
+		if departure.Before(now) {
+			departure = now
+		}
+		if q.opts.Rate > 0 {
+			departure = departure.Add(time.Duration(int64(pkt.N) * 8 * int64(time.Second) / q.opts.Rate))
+			if !sleepUntil(q.ctx, departure) {
+				return
+			}
+		}
+
+		q.lock.Lock()
+		q.queue = q.queue[1:]
+		q.queued -= int(pkt.N)
+		q.inFlight = append(q.inFlight, shapedPacket{pkt: pkt, deliver: departure.Add(q.opts.Delay)})
+		q.lock.Unlock()
+
+		notify(q.flightCh)
+	}
+}
+
+// Deliver the transmitted packets once their propagation delay has passed.
+func (q *shaperQueue) propagate() {
+	for {
+		q.lock.Lock()
+		if len(q.inFlight) == 0 {
+			q.lock.Unlock()
+			select {
+			case <-q.ctx.Done():
+				return
+			case <-q.flightCh:
+				continue
+			}
+		}
+		next := q.inFlight[0]
+		q.inFlight = q.inFlight[1:]
+		q.lock.Unlock()
+
+		if !sleepUntil(q.ctx, next.deliver) {
+			return
+		}
+		q.emit(next.pkt)
+	}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// Sleep until t. It reports false if ctx was canceled first.
+func sleepUntil(ctx context.Context, t time.Time) bool {
+	d := time.Until(t)
+	if d <= 0 {
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// ShapedDevice wraps a device and emulates a bottleneck link with the given
+// rate, propagation delay and queue size in each direction.
+type ShapedDevice struct {
+	device        Device
+	incoming      *shaperQueue
+	outgoing      *shaperQueue
+	incomingQueue chan Packet
+	err           error
+	stats         counters
+	lock          sync.Mutex
+	ctx           context.Context
+	cancel        context.CancelFunc
+}
+
+func NewShaper(device Device, opts ShaperOptions) *ShapedDevice {
+	s := &ShapedDevice{
+		device:        device,
+		incomingQueue: make(chan Packet, QUEUE_SIZE),
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.incoming = newShaperQueue(s.ctx, opts, func(pkt Packet) {
+		if !s.stats.enqueue(s.incomingQueue, pkt, s.ctx.Done()) {
+			pkt.Release()
+			return
+		}
+		s.stats.received(pkt)
+	})
+	s.outgoing = newShaperQueue(s.ctx, opts, func(pkt Packet) {
+		err := s.device.Write(pkt)
+		if err != nil {
+			s.stats.txErrors.Add(1)
+			log.Printf("write error: %s", err.Error())
+			return
+		}
+		s.stats.sent(pkt)
+	})
+
+	go s.readLoop()
+
+	return s
+}
+
+// Read packets from the underlying device into the incoming queue.
+func (s *ShapedDevice) readLoop() {
+	for {
+		pkt, err := s.device.Read()
+		if err != nil {
+			s.lock.Lock()
+			s.err = err
+			s.lock.Unlock()
+			s.cancel()
+			return
+		}
+		if !s.incoming.enqueue(pkt) {
+			pkt.Release()
+			s.stats.rxDropped.Add(1)
+			s.stats.queueFull.Add(1)
+		}
+	}
+}
+
+func (s *ShapedDevice) Close() error {
+	s.cancel()
+	return s.device.Close()
+}
+
+func (s *ShapedDevice) MTU() int {
+	return s.device.MTU()
+}
+
+func (s *ShapedDevice) GSOMaxSize() int {
+	return GSOMaxSize(s.device)
+}
+
+func (s *ShapedDevice) Stats() Stats {
+	return s.stats.snapshot()
+}
+
+func (s *ShapedDevice) Read() (Packet, error) {
+	select {
+	case pkt := <-s.incomingQueue:
+		return pkt, nil
+	case <-s.ctx.Done():
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if s.err != nil {
+			return Packet{}, s.err
+		}
+		return Packet{}, fmt.Errorf("device closed")
+	}
+}
+
+// Write queues the packet for transmission. Packets that do not fit in the
+// queue are dropped, like on a real bottleneck link.
+func (s *ShapedDevice) Write(pkt Packet) error {
+	select {
+	case <-s.ctx.Done():
+		pkt.Release()
+		return fmt.Errorf("device closed")
+	default:
+	}
+	if !s.outgoing.enqueue(pkt) {
+		pkt.Release()
+		s.stats.txDropped.Add(1)
+		s.stats.queueFull.Add(1)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package network
+
+import "sync/atomic"
+
+// Stats holds the packet counters of a device.
+type Stats struct {
+	RxPackets uint64
+	RxBytes   uint64
+	RxErrors  uint64
+	RxDropped uint64
+	TxPackets uint64
+	TxBytes   uint64
+	TxErrors  uint64
+	TxDropped uint64
+	// Number of times a packet had to wait because a queue was full.
+	QueueFull uint64
+}
+
+// counters is the concurrency-safe backing store of Stats.
+type counters struct {
+	rxPackets atomic.Uint64
+	rxBytes   atomic.Uint64
+	rxErrors  atomic.Uint64
+	rxDropped atomic.Uint64
+	txPackets atomic.Uint64
+	txBytes   atomic.Uint64
+	txErrors  atomic.Uint64
+	txDropped atomic.Uint64
+	queueFull atomic.Uint64
+}
+
+func (c *counters) received(pkt Packet) {
+	c.rxPackets.Add(1)
+	c.rxBytes.Add(uint64(pkt.N))
+}
+
+func (c *counters) sent(pkt Packet) {
+	c.txPackets.Add(1)
+	c.txBytes.Add(uint64(pkt.N))
+}
+
+func (c *counters) snapshot() Stats {
+	return Stats{
+		RxPackets: c.rxPackets.Load(),
+		RxBytes:   c.rxBytes.Load(),
+		RxErrors:  c.rxErrors.Load(),
+		RxDropped: c.rxDropped.Load(),
+		TxPackets: c.txPackets.Load(),
+		TxBytes:   c.txBytes.Load(),
+		TxErrors:  c.txErrors.Load(),
+		TxDropped: c.txDropped.Load(),
+		QueueFull: c.queueFull.Load(),
+	}
+}
+
+// Send pkt on queue, counting a queue-full event if it has to wait. It
+// reports false if done is closed first.
+func (c *counters) enqueue(queue chan Packet, pkt Packet, done <-chan struct{}) bool {
+	select {
+	case queue <- pkt:
+		return true
+	default:
+	}
+
+	c.queueFull.Add(1)
+	select {
+	case queue <- pkt:
+		return true
+	case <-done:
+		return false
+	}
+}
@@ -0,0 +1,242 @@
+package network
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// Time after which a learned address is forgotten if no traffic is seen
+	// from it.
+	SWITCH_AGING_TIME = 300 * time.Second
+)
+
+type switchEntry struct {
+	port    *SwitchPort
+	expires time.Time
+}
+
+type switchRoute struct {
+	prefix    uint32
+	prefixLen int
+	port      *SwitchPort
+}
+
+// Switch forwards packets between the devices attached to it. In ModeTap it
+// is a learning Ethernet switch: frames go to the port their destination MAC
+// was last seen on, and are flooded when it is unknown. In ModeTun it
+// forwards IPv4 packets by destination address, using the source addresses
+// it has seen and the routes added with AddRoute.
+type Switch struct {
+	mode   DeviceMode
+	ports  map[*SwitchPort]struct{}
+	macs   map[HardwareAddr]switchEntry
+	hosts  map[[4]byte]switchEntry
+	routes []switchRoute
+	lock   sync.Mutex
+}
+
+func NewSwitch(mode DeviceMode) *Switch {
+	return &Switch{
+		mode:  mode,
+		ports: make(map[*SwitchPort]struct{}),
+		macs:  make(map[HardwareAddr]switchEntry),
+		hosts: make(map[[4]byte]switchEntry),
+	}
+}
+
+// SwitchPort is a device attached to a Switch. Packets written to it are
+// forwarded to the other ports.
+type SwitchPort struct {
+	sw            *Switch
+	incomingQueue chan Packet
+	stats         counters
+	done          chan struct{}
+	closeOnce     sync.Once
+}
+
+// Attach returns a new port of the switch.
+func (s *Switch) Attach() *SwitchPort {
+	port := &SwitchPort{
+		sw:            s,
+		incomingQueue: make(chan Packet, QUEUE_SIZE),
+		done:          make(chan struct{}),
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.ports[port] = struct{}{}
+	return port
+}
+
+// AddRoute sends IPv4 packets for the prefix to port. It is only used in
+// ModeTun, and learned host addresses take precedence over it.
+func (s *Switch) AddRoute(prefix [4]byte, prefixLen int, port *SwitchPort) {
+	mask := ^uint32(0) << (32 - prefixLen)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.routes = append(s.routes, switchRoute{
+		prefix:    binary.BigEndian.Uint32(prefix[:]) & mask,
+		prefixLen: prefixLen,
+		port:      port,
+	})
+}
+
+// Remove the port and everything learned or routed through it.
+func (s *Switch) detach(port *SwitchPort) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.ports, port)
+	for mac, entry := range s.macs {
+		if entry.port == port {
+			delete(s.macs, mac)
+		}
+	}
+	for addr, entry := range s.hosts {
+		if entry.port == port {
+			delete(s.hosts, addr)
+		}
+	}
+	routes := s.routes[:0]
+	for _, route := range s.routes {
+		if route.port != port {
+			routes = append(routes, route)
+		}
+	}
+	s.routes = routes
+}
+
+// Return the ports the packet from in should be delivered to.
+func (s *Switch) destinations(in *SwitchPort, pkt []byte) []*SwitchPort {
+	now := time.Now()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var out *SwitchPort
+	flood := true
+	if s.mode == ModeTap {
+		if len(pkt) < ETHERNET_HEADER_LEN {
+			return nil
+		}
+		var dst, src HardwareAddr
+		copy(dst[:], pkt[0:6])
+		copy(src[:], pkt[6:12])
+		if !src.IsMulticast() {
+			s.macs[src] = switchEntry{port: in, expires: now.Add(SWITCH_AGING_TIME)}
+		}
+		if entry, ok := s.macs[dst]; ok && !dst.IsMulticast() && now.Before(entry.expires) {
+			out, flood = entry.port, false
+		}
+	} else {
+		if len(pkt) < 20 || pkt[0]>>4 != 4 {
+			return nil
+		}
+		var dst, src [4]byte
+		copy(src[:], pkt[12:16])
+		copy(dst[:], pkt[16:20])
+		if src != ([4]byte{}) {
+			s.hosts[src] = switchEntry{port: in, expires: now.Add(SWITCH_AGING_TIME)}
+		}
+		if entry, ok := s.hosts[dst]; ok && now.Before(entry.expires) {
+			out, flood = entry.port, false
+		} else if route, ok := s.route(dst); ok {
+			out, flood = route.port, false
+		}
+	}
+
+	if !flood {
+		if out == in {
+			return nil
+		}
+		return []*SwitchPort{out}
+	}
+	ports := make([]*SwitchPort, 0, len(s.ports))
+	for port := range s.ports {
+		if port != in {
+			ports = append(ports, port)
+		}
+	}
+	return ports
+}
+
+// Return the longest prefix route for dst.
+func (s *Switch) route(dst [4]byte) (switchRoute, bool) {
+	addr := binary.BigEndian.Uint32(dst[:])
+	best := switchRoute{prefixLen: -1}
+	for _, route := range s.routes {
+		mask := ^uint32(0) << (32 - route.prefixLen)
+		if addr&mask == route.prefix && route.prefixLen > best.prefixLen {
+			best = route
+		}
+	}
+	return best, best.prefixLen >= 0
+}
+
+// Deliver the packet to the port. Packets are dropped if the port's queue is
+// full, like on the egress queue of a real switch.
+func (p *SwitchPort) deliver(pkt Packet) {
+	select {
+	case <-p.done:
+		return
+	default:
+	}
+
+	select {
+	case p.incomingQueue <- pkt:
+	default:
+		p.stats.rxDropped.Add(1)
+		p.stats.queueFull.Add(1)
+	}
+}
+
+// Close detaches the port from the switch.
+func (p *SwitchPort) Close() error {
+	p.closeOnce.Do(func() {
+		p.sw.detach(p)
+		close(p.done)
+	})
+	return nil
+}
+
+func (p *SwitchPort) MTU() int {
+	return MTU
+}
+
+func (p *SwitchPort) Stats() Stats {
+	return p.stats.snapshot()
+}
+
+func (p *SwitchPort) Read() (Packet, error) {
+	select {
+	case pkt := <-p.incomingQueue:
+		p.stats.received(pkt)
+		return pkt, nil
+	case <-p.done:
+		return Packet{}, fmt.Errorf("device closed")
+	}
+}
+
+func (p *SwitchPort) Write(pkt Packet) error {
+	select {
+	case <-p.done:
+		pkt.Release()
+		p.stats.txDropped.Add(1)
+		return fmt.Errorf("device closed")
+	default:
+	}
+
+	data := pkt.Buf[:pkt.N]
+	for _, port := range p.sw.destinations(p, data) {
+		buf := make([]byte, pkt.N)
+		copy(buf, data)
+		port.deliver(Packet{Buf: buf, N: pkt.N, Protocol: pkt.Protocol})
+	}
+	p.stats.sent(pkt)
+	pkt.Release()
+	return nil
+}
@@ -2,9 +2,13 @@ package network
 
 import (
 	"context"
+	"encoding/binary"
 	"fmt"
+	"hash/fnv"
 	"log"
+	"net"
 	"os"
+	"sync"
 	"syscall"
 	"unsafe"
 )
@@ -15,125 +19,562 @@ type ifreq struct {
 }
 
 const (
-	TUNSETIFF   = 0x400454ca
-	IFF_TUN     = 0x0001
-	IFF_NO_PI   = 0x1000
-	PACKET_SIZE = 2048
-	QUEUE_SIZE  = 10
+	TUNSETIFF       = 0x400454ca
+	TUNSETOFFLOAD   = 0x400454d0
+	IFF_TUN         = 0x0001
+	IFF_TAP         = 0x0002
+	IFF_NO_PI       = 0x1000
+	IFF_MULTI_QUEUE = 0x0100
+	IFF_VNET_HDR    = 0x4000
+	TUN_F_CSUM      = 0x01
+	TUN_F_TSO4      = 0x02
+	TUN_PI_LEN      = 4
+	TUN_PKT_STRIP   = 0x0001
+	PACKET_SIZE     = 2048
+	QUEUE_SIZE      = 10
+	MTU             = 1500
+
+	DEFAULT_TUN_NAME = "tun0"
 )
 
 type Packet struct {
 	Buf []byte
 	N   uintptr
+	// EtherType of the packet if the link reported one, otherwise 0.
+	Protocol uint16
+	// Buffer holding Buf, if the packet was built in one.
+	buffer *Buffer
 }
 
 type NetDevice struct {
-	file          *os.File
-	incomingQueue chan Packet
-	outgoingQueue chan Packet
-	ctx           context.Context
-	cancel        context.CancelFunc
+	files          []*os.File
+	name           string
+	mode           DeviceMode
+	mtu            int
+	offload        bool
+	packetInfo     bool
+	incomingQueue  chan Packet
+	outgoingQueues []chan Packet
+	stats          counters
+	err            error
+	lock           sync.Mutex
+	closeOnce      sync.Once
+	ctx            context.Context
+	cancel         context.CancelFunc
+}
+
+// DeviceMode selects whether the device carries IP packets or Ethernet frames.
+type DeviceMode int
+
+const (
+	ModeTun DeviceMode = iota
+	ModeTap
+)
+
+// TunOptions configures the TUN device created by NewTunWithOptions.
+// Zero values leave the corresponding setting untouched.
+type TunOptions struct {
+	// Interface name. Defaults to "tun0".
+	Name string
+	// ModeTun for layer-3 packets or ModeTap for Ethernet frames.
+	Mode DeviceMode
+	// Link MTU. Defaults to the MTU the kernel assigns.
+	MTU int
+	// IPv4 address assigned to the interface.
+	LocalAddr [4]byte
+	// Address of the other end of a point-to-point link.
+	PeerAddr [4]byte
+	// Prefix length of LocalAddr.
+	PrefixLen int
+	// Number of queues. More than one opens the device with IFF_MULTI_QUEUE
+	// and runs a reader and a writer goroutine per queue.
+	Queues int
+	// Exchange packets with a virtio_net_hdr so the kernel can hand over
+	// coalesced TCP segments and split large ones, and leave checksums to
+	// whichever side has the packet last.
+	Offload bool
+	// Keep the tun_pi header, which carries the EtherType of every packet,
+	// instead of opening the device with IFF_NO_PI.
+	PacketInfo bool
 }
 
 func NewTun() (*NetDevice, error) {
-	file, err := os.OpenFile("/dev/net/tun", os.O_RDWR, 0)
-	if err != nil {
-		return nil, fmt.Errorf("open error: %s", err.Error())
+	return NewTunWithOptions(TunOptions{})
+}
+
+// Create a TUN device, bring it up and assign its address through netlink.
+func NewTunWithOptions(opts TunOptions) (*NetDevice, error) {
+	name := opts.Name
+	if name == "" {
+		name = DEFAULT_TUN_NAME
+	}
+	if len(name) >= len(ifreq{}.ifrName) {
+		return nil, fmt.Errorf("interface name too long: %s", name)
+	}
+
+	var flags int16
+	if !opts.PacketInfo {
+		flags |= IFF_NO_PI
+	}
+	switch opts.Mode {
+	case ModeTun:
+		flags |= IFF_TUN
+	case ModeTap:
+		flags |= IFF_TAP
+	default:
+		return nil, fmt.Errorf("invalid device mode: %d", opts.Mode)
+	}
+
+	queues := opts.Queues
+	if queues < 1 {
+		queues = 1
+	}
+	if queues > 1 {
+		flags |= IFF_MULTI_QUEUE
+	}
+	if opts.Offload {
+		flags |= IFF_VNET_HDR
 	}
 
 	ifr := ifreq{}
-	copy(ifr.ifrName[:], []byte("tun0"))
-	ifr.ifrFlags = IFF_TUN | IFF_NO_PI
+	copy(ifr.ifrName[:], []byte(name))
+	ifr.ifrFlags = flags
 
-	_, _, sysErr := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), uintptr(TUNSETIFF), uintptr(unsafe.Pointer(&ifr)))
-	if sysErr != 0 {
-		return nil, fmt.Errorf("ioctl error: %s", sysErr.Error())
+	files := make([]*os.File, 0, queues)
+	closeFiles := func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}
+	for i := 0; i < queues; i++ {
+		file, err := openTun(&ifr, opts.Offload)
+		if err != nil {
+			closeFiles()
+			return nil, err
+		}
+		files = append(files, file)
+	}
+
+	mtu, err := configure(ifr.name(), opts)
+	if err != nil {
+		closeFiles()
+		return nil, err
 	}
 
+	outgoingQueues := make([]chan Packet, queues)
+	for i := range outgoingQueues {
+		outgoingQueues[i] = make(chan Packet, QUEUE_SIZE)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
 	return &NetDevice{
-		file:          file,
-		incomingQueue: make(chan Packet, QUEUE_SIZE),
-		outgoingQueue: make(chan Packet, QUEUE_SIZE),
+		files:          files,
+		name:           ifr.name(),
+		mode:           opts.Mode,
+		mtu:            mtu,
+		offload:        opts.Offload,
+		packetInfo:     opts.PacketInfo,
+		incomingQueue:  make(chan Packet, QUEUE_SIZE),
+		outgoingQueues: outgoingQueues,
+		ctx:            ctx,
+		cancel:         cancel,
 	}, nil
 }
 
+// Open a TUN/TAP queue in non-blocking mode. The returned file is registered
+// with the runtime's epoll-based poller, so blocked reads and writes return
+// as soon as the file is closed.
+func openTun(ifr *ifreq, offload bool) (*os.File, error) {
+	fd, err := syscall.Open("/dev/net/tun", syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("open error: %s", err.Error())
+	}
+
+	_, _, sysErr := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), uintptr(TUNSETIFF), uintptr(unsafe.Pointer(ifr)))
+	if sysErr != 0 {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("ioctl error: %s", sysErr.Error())
+	}
+
+	if offload {
+		_, _, sysErr := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), uintptr(TUNSETOFFLOAD), uintptr(TUN_F_CSUM|TUN_F_TSO4))
+		if sysErr != 0 {
+			syscall.Close(fd)
+			return nil, fmt.Errorf("ioctl error: %s", sysErr.Error())
+		}
+	}
+
+	err = syscall.SetNonblock(fd, true)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("nonblock error: %s", err.Error())
+	}
+
+	return os.NewFile(uintptr(fd), "/dev/net/tun"), nil
+}
+
+// Return the interface name the kernel assigned.
+func (ifr *ifreq) name() string {
+	for i, b := range ifr.ifrName {
+		if b == 0 {
+			return string(ifr.ifrName[:i])
+		}
+	}
+	return string(ifr.ifrName[:])
+}
+
+// Bring the interface up, assign its address and return its MTU.
+func configure(name string, opts TunOptions) (int, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return 0, fmt.Errorf("interface error: %s", err.Error())
+	}
+
+	if opts.LocalAddr != [4]byte{} {
+		prefixLen := opts.PrefixLen
+		if prefixLen == 0 {
+			prefixLen = 32
+		}
+		if prefixLen > 32 {
+			return 0, fmt.Errorf("invalid prefix length: %d", prefixLen)
+		}
+		err := addAddress(iface.Index, opts.LocalAddr, opts.PeerAddr, prefixLen)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	err = setLinkUp(iface.Index, opts.MTU)
+	if err != nil {
+		return 0, err
+	}
+
+	if opts.MTU > 0 {
+		return opts.MTU, nil
+	}
+	return iface.MTU, nil
+}
+
+// Close stops the device. It is safe to call even if Bind was never called.
 func (t *NetDevice) Close() error {
-	err := t.file.Close()
+	var err error
+	t.closeOnce.Do(func() {
+		t.cancel()
+		for _, file := range t.files {
+			if cerr := file.Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}
+	})
 	if err != nil {
 		return fmt.Errorf("close error: %s", err.Error())
 	}
-	t.cancel()
 
 	return nil
 }
 
-func (t *NetDevice) read(buf []byte) (uintptr, error) {
-	n, _, sysErr := syscall.Syscall(syscall.SYS_READ, t.file.Fd(), uintptr(unsafe.Pointer(&buf[0])), uintptr(len(buf)))
-	if sysErr != 0 {
-		return 0, fmt.Errorf("read error: %s", sysErr.Error())
+// Name returns the interface name.
+func (t *NetDevice) Name() string {
+	return t.name
+}
+
+// Mode returns whether the device carries IP packets or Ethernet frames.
+func (t *NetDevice) Mode() DeviceMode {
+	return t.mode
+}
+
+// LinkType returns the pcap link type of the packets the device carries.
+func (t *NetDevice) LinkType() uint16 {
+	if t.mode == ModeTap {
+		return LINKTYPE_ETHERNET
 	}
-	return n, nil
+	return LINKTYPE_RAW
 }
 
-func (t *NetDevice) write(buf []byte) (uintptr, error) {
-	n, _, sysErr := syscall.Syscall(syscall.SYS_WRITE, t.file.Fd(), uintptr(unsafe.Pointer(&buf[0])), uintptr(len(buf)))
-	if sysErr != 0 {
-		return 0, fmt.Errorf("write error: %s", sysErr.Error())
+func (t *NetDevice) MTU() int {
+	return t.mtu
+}
+
+// GSOMaxSize returns GSO_MAX_SIZE if the device was opened with Offload,
+// since the kernel segments larger TCP packets, otherwise the MTU.
+func (t *NetDevice) GSOMaxSize() int {
+	if t.offload {
+		return GSO_MAX_SIZE
 	}
-	return n, nil
+	return t.mtu
 }
 
+func (t *NetDevice) Stats() Stats {
+	return t.stats.snapshot()
+}
+
+// Queues returns the number of queues the device was opened with.
+func (t *NetDevice) Queues() int {
+	return len(t.files)
+}
+
+func (t *NetDevice) read(queue int, buf []byte) (uintptr, error) {
+	n, err := t.files[queue].Read(buf)
+	if err != nil {
+		return 0, fmt.Errorf("read error: %s", err.Error())
+	}
+	return uintptr(n), nil
+}
+
+func (t *NetDevice) write(queue int, buf []byte) (uintptr, error) {
+	n, err := t.files[queue].Write(buf)
+	if err != nil {
+		return 0, fmt.Errorf("write error: %s", err.Error())
+	}
+	return uintptr(n), nil
+}
+
+// Start a reader and a writer goroutine for every queue. They stop when the
+// device is closed. A read error ends the incoming queue and is returned by
+// Read.
 func (tun *NetDevice) Bind() {
-	tun.ctx, tun.cancel = context.WithCancel(context.Background())
+	var readers sync.WaitGroup
+	for i := range tun.files {
+		readers.Add(1)
+		go tun.readLoop(i, &readers)
+		go tun.writeLoop(i)
+	}
 
 	go func() {
-		for {
-			select {
-			case <-tun.ctx.Done():
-				return
-			default:
-				buf := make([]byte, PACKET_SIZE)
-				n, err := tun.read(buf)
-				if err != nil {
-					log.Printf("read error: %s", err.Error())
-				}
-				packet := Packet{
-					Buf: buf[:n],
-					N:   n,
-				}
-				tun.incomingQueue <- packet
+		readers.Wait()
+		close(tun.incomingQueue)
+	}()
+}
+
+func (tun *NetDevice) readLoop(queue int, readers *sync.WaitGroup) {
+	defer readers.Done()
+
+	// The buffer must hold the largest packet the MTU allows, or the kernel
+	// truncates it without reporting an error.
+	size := tun.mtu
+	if tun.mode == ModeTap {
+		size += ETHERNET_HEADER_LEN
+	}
+	if size < PACKET_SIZE {
+		size = PACKET_SIZE
+	}
+	if tun.offload {
+		size = VNET_HDR_LEN + ETHERNET_HEADER_LEN + GSO_MAX_SIZE
+	}
+	if tun.packetInfo {
+		size += TUN_PI_LEN
+	}
+	for {
+		b := AllocBuffer(size)
+		n, err := tun.read(queue, b.Put(size))
+		if err != nil {
+			b.Release()
+			if tun.ctx.Err() == nil {
+				tun.stats.rxErrors.Add(1)
 			}
+			tun.setErr(err)
+			tun.cancel()
+			return
 		}
-	}()
+		b.Trim(int(n))
+		packet, err := tun.decapsulate(b)
+		if err != nil {
+			b.Release()
+			tun.stats.rxErrors.Add(1)
+			log.Printf("read error: %s", err.Error())
+			continue
+		}
+		tun.stats.received(packet)
+		if !tun.stats.enqueue(tun.incomingQueue, packet, tun.ctx.Done()) {
+			packet.Release()
+			tun.stats.rxDropped.Add(1)
+			return
+		}
+	}
+}
 
-	go func() {
-		for {
-			select {
-			case <-tun.ctx.Done():
-				return
-			case pkt := <-tun.outgoingQueue:
-				_, err := tun.write(pkt.Buf[:pkt.N])
-				if err != nil {
-					log.Printf("write error: %s", err.Error())
-				}
+func (tun *NetDevice) writeLoop(queue int) {
+	for {
+		select {
+		case <-tun.ctx.Done():
+			return
+		case pkt := <-tun.outgoingQueues[queue]:
+			_, err := tun.write(queue, tun.encapsulate(pkt))
+			if err != nil {
+				tun.stats.txErrors.Add(1)
+				log.Printf("write error: %s", err.Error())
+			} else {
+				tun.stats.sent(pkt)
 			}
+			pkt.Release()
 		}
-	}()
+	}
 }
 
-func (t *NetDevice) Read() (Packet, error) {
-	pkt, ok := <-t.incomingQueue
-	if !ok {
-		return Packet{}, fmt.Errorf("incoming queue is closed")
+// Record the error that stopped the device. Errors caused by closing the
+// device are reported as such.
+func (t *NetDevice) setErr(err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.ctx.Err() != nil {
+		err = fmt.Errorf("device closed")
+	}
+	if t.err == nil {
+		t.err = err
 	}
-	return pkt, nil
 }
 
-func (t *NetDevice) Write(pkt Packet) error {
+func (t *NetDevice) Read() (Packet, error) {
 	select {
-	case t.outgoingQueue <- pkt:
-		return nil
+	case pkt, ok := <-t.incomingQueue:
+		if ok {
+			return pkt, nil
+		}
 	case <-t.ctx.Done():
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.err != nil {
+		return Packet{}, t.err
+	}
+	return Packet{}, fmt.Errorf("device closed")
+}
+
+// Write queues the packet on the queue selected by its flow hash, so all
+// packets of a connection leave through the same queue.
+func (t *NetDevice) Write(pkt Packet) error {
+	queue := 0
+	if len(t.outgoingQueues) > 1 {
+		queue = int(t.flowHash(pkt.Buf[:pkt.N]) % uint32(len(t.outgoingQueues)))
+	}
+
+	if t.ctx.Err() != nil || !t.stats.enqueue(t.outgoingQueues[queue], pkt, t.ctx.Done()) {
+		pkt.Release()
+		t.stats.txDropped.Add(1)
 		return fmt.Errorf("device closed")
 	}
+	return nil
+}
+
+// Return a hash of the addresses, protocol and ports of an IPv4 packet.
+func (t *NetDevice) flowHash(buf []byte) uint32 {
+	if t.mode == ModeTap {
+		if len(buf) < ETHERNET_HEADER_LEN || binary.BigEndian.Uint16(buf[12:14]) != ETHER_TYPE_IPV4 {
+			return 0
+		}
+		buf = buf[ETHERNET_HEADER_LEN:]
+	}
+	if len(buf) < 20 || buf[0]>>4 != 4 {
+		return 0
+	}
+
+	h := fnv.New32a()
+	h.Write(buf[9:10])
+	h.Write(buf[12:20])
+
+	ihl := int(buf[0]&0x0F) * 4
+	fragment := binary.BigEndian.Uint16(buf[6:8])&0x3FFF != 0
+	if (buf[9] == 6 || buf[9] == 17) && !fragment && len(buf) >= ihl+4 {
+		h.Write(buf[ihl : ihl+4])
+	}
+	return h.Sum32()
+}
+
+// Remove the headers the kernel adds in front of every packet, tun_pi first,
+// then virtio_net_hdr, by pulling them off the buffer the packet was read
+// into.
+func (t *NetDevice) decapsulate(b *Buffer) (Packet, error) {
+	var protocol uint16
+	if t.packetInfo {
+		if b.Len() < TUN_PI_LEN {
+			return Packet{}, fmt.Errorf("invalid packet information length")
+		}
+		pi := b.Pull(TUN_PI_LEN)
+		if binary.BigEndian.Uint16(pi[0:2])&TUN_PKT_STRIP != 0 {
+			return Packet{}, fmt.Errorf("packet truncated")
+		}
+		protocol = binary.BigEndian.Uint16(pi[2:4])
+	}
+
+	if t.offload {
+		hdr, err := unmarshalVnet(b.Bytes())
+		if err != nil {
+			return Packet{}, err
+		}
+		b.Pull(VNET_HDR_LEN)
+		err = hdr.completeChecksum(b.Bytes())
+		if err != nil {
+			return Packet{}, err
+		}
+	}
+
+	pkt := b.Packet()
+	pkt.Protocol = protocol
+	return pkt, nil
+}
+
+// Return the packet prefixed with the headers the kernel expects. They are
+// written in the headroom of the packet's buffer if it has enough.
+func (t *NetDevice) encapsulate(pkt Packet) []byte {
+	data := pkt.Buf[:pkt.N]
+	if !t.packetInfo && !t.offload {
+		return data
+	}
+
+	offset := 0
+	if t.packetInfo {
+		offset += TUN_PI_LEN
+	}
+	if t.offload {
+		offset += VNET_HDR_LEN
+	}
+	var buf []byte
+	if pushed, ok := pkt.push(offset); ok {
+		buf = pushed.Buf
+	} else {
+		buf = make([]byte, offset+len(data))
+		copy(buf[offset:], data)
+	}
+
+	if t.packetInfo {
+		binary.BigEndian.PutUint16(buf[0:2], 0)
+		binary.BigEndian.PutUint16(buf[2:4], t.protocol(pkt))
+	}
+	if t.offload {
+		l3 := 0
+		if t.mode == ModeTap {
+			l3 = ETHERNET_HEADER_LEN
+		}
+		hdr := VnetHeader{GSOType: VIRTIO_NET_HDR_GSO_NONE}
+		if t.protocol(pkt) == ETHER_TYPE_IPV4 {
+			hdr = gsoHeader(buf[offset:], l3, t.mtu)
+		}
+		hdr.marshalTo(buf[offset-VNET_HDR_LEN:])
+	}
+	return buf
+}
+
+// Return the EtherType of an outgoing packet, derived from the packet itself
+// if it does not carry one.
+func (t *NetDevice) protocol(pkt Packet) uint16 {
+	if pkt.Protocol != 0 {
+		return pkt.Protocol
+	}
+	if t.mode == ModeTap {
+		if pkt.N < ETHERNET_HEADER_LEN {
+			return 0
+		}
+		return binary.BigEndian.Uint16(pkt.Buf[12:14])
+	}
+	if pkt.N == 0 {
+		return 0
+	}
+	switch pkt.Buf[0] >> 4 {
+	case 4:
+		return ETHER_TYPE_IPV4
+	case 6:
+		return ETHER_TYPE_IPV6
+	}
+	return 0
 }
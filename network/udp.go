@@ -0,0 +1,111 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// UdpDevice carries raw IP packets in UDP datagrams between two endpoints,
+// a point-to-point tunnel that needs neither root nor /dev/net/tun.
+type UdpDevice struct {
+	conn      *net.UDPConn
+	remote    *net.UDPAddr
+	mtu       int
+	stats     counters
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Create a device that listens on the local address and sends to the remote
+// address, for example NewUdp("127.0.0.1:7000", "127.0.0.1:7001"). Datagrams
+// from other addresses are dropped.
+func NewUdp(local, remote string) (*UdpDevice, error) {
+	laddr, err := net.ResolveUDPAddr("udp", local)
+	if err != nil {
+		return nil, fmt.Errorf("resolve error: %s", err.Error())
+	}
+	raddr, err := net.ResolveUDPAddr("udp", remote)
+	if err != nil {
+		return nil, fmt.Errorf("resolve error: %s", err.Error())
+	}
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, fmt.Errorf("listen error: %s", err.Error())
+	}
+
+	return &UdpDevice{
+		conn:   conn,
+		remote: raddr,
+		mtu:    MTU,
+		closed: make(chan struct{}),
+	}, nil
+}
+
+// LocalAddr returns the address the device listens on.
+func (u *UdpDevice) LocalAddr() *net.UDPAddr {
+	return u.conn.LocalAddr().(*net.UDPAddr)
+}
+
+func (u *UdpDevice) Close() error {
+	var err error
+	u.closeOnce.Do(func() {
+		close(u.closed)
+		err = u.conn.Close()
+	})
+	return err
+}
+
+func (u *UdpDevice) MTU() int {
+	return u.mtu
+}
+
+func (u *UdpDevice) Stats() Stats {
+	return u.stats.snapshot()
+}
+
+func (u *UdpDevice) Read() (Packet, error) {
+	for {
+		b := AllocBuffer(PACKET_SIZE)
+		n, addr, err := u.conn.ReadFromUDP(b.Put(PACKET_SIZE))
+		if err != nil {
+			b.Release()
+			if errors.Is(err, net.ErrClosed) {
+				return Packet{}, fmt.Errorf("device closed")
+			}
+			u.stats.rxErrors.Add(1)
+			return Packet{}, fmt.Errorf("read error: %s", err.Error())
+		}
+		if !addr.IP.Equal(u.remote.IP) || addr.Port != u.remote.Port {
+			b.Release()
+			u.stats.rxDropped.Add(1)
+			continue
+		}
+
+		b.Trim(n)
+		pkt := b.Packet()
+		u.stats.received(pkt)
+		return pkt, nil
+	}
+}
+
+func (u *UdpDevice) Write(pkt Packet) error {
+	select {
+	case <-u.closed:
+		pkt.Release()
+		u.stats.txDropped.Add(1)
+		return fmt.Errorf("device closed")
+	default:
+	}
+
+	defer pkt.Release()
+
+	_, err := u.conn.WriteToUDP(pkt.Buf[:pkt.N], u.remote)
+	if err != nil {
+		u.stats.txErrors.Add(1)
+		return fmt.Errorf("write error: %s", err.Error())
+	}
+	u.stats.sent(pkt)
+	return nil
+}
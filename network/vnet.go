@@ -0,0 +1,124 @@
+package network
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	VNET_HDR_LEN = 10
+
+	VIRTIO_NET_HDR_F_NEEDS_CSUM = 0x01
+	VIRTIO_NET_HDR_GSO_NONE     = 0x00
+	VIRTIO_NET_HDR_GSO_TCPV4    = 0x01
+
+	// Largest packet the kernel hands over or accepts with offloads enabled.
+	GSO_MAX_SIZE = 65535
+)
+
+// VnetHeader is the virtio_net_hdr that precedes every packet when the
+// device is opened with IFF_VNET_HDR. Its fields are in host byte order.
+type VnetHeader struct {
+	Flags      uint8
+	GSOType    uint8
+	HdrLen     uint16
+	GSOSize    uint16
+	CsumStart  uint16
+	CsumOffset uint16
+}
+
+// Create a new virtio-net header from packet.
+func unmarshalVnet(pkt []byte) (*VnetHeader, error) {
+	if len(pkt) < VNET_HDR_LEN {
+		return nil, fmt.Errorf("invalid virtio-net header length")
+	}
+
+	return &VnetHeader{
+		Flags:      pkt[0],
+		GSOType:    pkt[1],
+		HdrLen:     binary.LittleEndian.Uint16(pkt[2:4]),
+		GSOSize:    binary.LittleEndian.Uint16(pkt[4:6]),
+		CsumStart:  binary.LittleEndian.Uint16(pkt[6:8]),
+		CsumOffset: binary.LittleEndian.Uint16(pkt[8:10]),
+	}, nil
+}
+
+// Write the header into the first VNET_HDR_LEN bytes of buf.
+func (h *VnetHeader) marshalTo(buf []byte) {
+	buf[0] = h.Flags
+	buf[1] = h.GSOType
+	binary.LittleEndian.PutUint16(buf[2:4], h.HdrLen)
+	binary.LittleEndian.PutUint16(buf[4:6], h.GSOSize)
+	binary.LittleEndian.PutUint16(buf[6:8], h.CsumStart)
+	binary.LittleEndian.PutUint16(buf[8:10], h.CsumOffset)
+}
+
+// Complete a checksum the kernel left partial. The checksum field already
+// holds the pseudo-header sum, so summing from CsumStart gives the result.
+func (h *VnetHeader) completeChecksum(pkt []byte) error {
+	if h.Flags&VIRTIO_NET_HDR_F_NEEDS_CSUM == 0 {
+		return nil
+	}
+	start := int(h.CsumStart)
+	field := start + int(h.CsumOffset)
+	if field+2 > len(pkt) {
+		return fmt.Errorf("invalid checksum offset")
+	}
+
+	binary.BigEndian.PutUint16(pkt[field:field+2], ^foldChecksum(sumChecksum(pkt[start:], 0)))
+	return nil
+}
+
+// Return the virtio-net header for a packet about to be written. TCP packets
+// larger than the MTU are marked for segmentation by the kernel, and their
+// checksum field is replaced with the pseudo-header sum the kernel expects.
+// l3 is the offset of the IPv4 header in pkt.
+func gsoHeader(pkt []byte, l3 int, mtu int) VnetHeader {
+	ip := pkt[l3:]
+	if len(pkt)-l3 <= mtu || len(ip) < 20 || ip[0]>>4 != 4 || ip[9] != 6 {
+		return VnetHeader{GSOType: VIRTIO_NET_HDR_GSO_NONE}
+	}
+	ihl := int(ip[0]&0x0F) * 4
+	if len(ip) < ihl+20 {
+		return VnetHeader{GSOType: VIRTIO_NET_HDR_GSO_NONE}
+	}
+	tcp := ip[ihl:]
+	tcpHdrLen := int(tcp[12]>>4) * 4
+	if len(tcp) < tcpHdrLen {
+		return VnetHeader{GSOType: VIRTIO_NET_HDR_GSO_NONE}
+	}
+
+	pseudo := make([]byte, 12)
+	copy(pseudo[0:8], ip[12:20])
+	pseudo[9] = ip[9]
+	binary.BigEndian.PutUint16(pseudo[10:12], uint16(len(tcp)))
+	binary.BigEndian.PutUint16(tcp[16:18], foldChecksum(sumChecksum(pseudo, 0)))
+
+	return VnetHeader{
+		Flags:      VIRTIO_NET_HDR_F_NEEDS_CSUM,
+		GSOType:    VIRTIO_NET_HDR_GSO_TCPV4,
+		HdrLen:     uint16(l3 + ihl + tcpHdrLen),
+		GSOSize:    uint16(mtu - ihl - tcpHdrLen),
+		CsumStart:  uint16(l3 + ihl),
+		CsumOffset: 16,
+	}
+}
+
+// Add buf to a running one's complement sum.
+func sumChecksum(buf []byte, sum uint32) uint32 {
+	n := len(buf)
+	for i := 0; i+1 < n; i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(buf[i : i+2]))
+	}
+	if n%2 == 1 {
+		sum += uint32(buf[n-1]) << 8
+	}
+	return sum
+}
+
+func foldChecksum(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return uint16(sum)
+}
@@ -76,7 +76,10 @@ func (m *ConnectionManager) recv(queue *TcpPacketQueue, pkt TcpPacket) {
 		}, nil)
 		m.update(pkt, StateEstablished, true)
 
-		m.AcceptConnectionQueue <- conn
+		select {
+		case m.AcceptConnectionQueue <- conn:
+		case <-queue.ctx.Done():
+		}
 	}
 
 	if ok && pkt.TcpHeader.Flags.FIN && conn.State == StateEstablished {
@@ -0,0 +1,20 @@
+package transport
+
+import "sync/atomic"
+
+// Stats holds the counters of a TcpPacketQueue.
+type Stats struct {
+	// Segments dropped because the incoming queue was full.
+	InQueueDrops uint64
+}
+
+// counters is the concurrency-safe backing store of Stats.
+type counters struct {
+	inQueueDrops atomic.Uint64
+}
+
+func (c *counters) snapshot() Stats {
+	return Stats{
+		InQueueDrops: c.inQueueDrops.Load(),
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"sync"
 
+	"github.com/kawa1214/tcp-ip-go/icmp"
 	"github.com/kawa1214/tcp-ip-go/internet"
 	"github.com/kawa1214/tcp-ip-go/network"
 )
@@ -21,7 +23,12 @@ type TcpPacket struct {
 
 type TcpPacketQueue struct {
 	manager       *ConnectionManager
+	ip            *internet.IpPacketQueue
+	incomingQueue chan internet.IpPacket
 	outgoingQueue chan network.Packet
+	ports         map[uint16]struct{}
+	stats         counters
+	lock          sync.Mutex
 	ctx           context.Context
 	cancel        context.CancelFunc
 }
@@ -30,31 +37,79 @@ func NewTcpPacketQueue() *TcpPacketQueue {
 	ConnectionManager := NewConnectionManager()
 	return &TcpPacketQueue{
 		manager:       ConnectionManager,
+		incomingQueue: make(chan internet.IpPacket, QUEUE_SIZE),
 		outgoingQueue: make(chan network.Packet, QUEUE_SIZE),
+		ports:         make(map[uint16]struct{}),
 	}
 }
 
+// Listen accepts connections to the port. Once a port is added, SYNs to
+// other ports are answered with an ICMP Port Unreachable message. Until
+// then connections to every port are accepted.
+func (tcp *TcpPacketQueue) Listen(port uint16) {
+	tcp.lock.Lock()
+	defer tcp.lock.Unlock()
+	tcp.ports[port] = struct{}{}
+}
+
+// Report whether connections to the port are accepted.
+func (tcp *TcpPacketQueue) listening(port uint16) bool {
+	tcp.lock.Lock()
+	defer tcp.lock.Unlock()
+	if len(tcp.ports) == 0 {
+		return true
+	}
+	_, ok := tcp.ports[port]
+	return ok
+}
+
+// Stats returns the segment counters.
+func (tcp *TcpPacketQueue) Stats() Stats {
+	return tcp.stats.snapshot()
+}
+
 func (tcp *TcpPacketQueue) ManageQueues(ip *internet.IpPacketQueue) {
+	tcp.ip = ip
 	tcp.ctx, tcp.cancel = context.WithCancel(context.Background())
+	// The handler runs on the IP reader goroutine and must not block it.
+	// When the TCP reader falls behind, for example because nobody calls
+	// Accept, segments are dropped and the peer retransmits them.
+	ip.Handle(internet.TCP_PROTOCOL, func(ipPkt internet.IpPacket) {
+		select {
+		case tcp.incomingQueue <- ipPkt:
+		default:
+			tcp.stats.inQueueDrops.Add(1)
+			ipPkt.Packet.Release()
+		}
+	})
+
 	go func() {
 		for {
 			select {
 			case <-tcp.ctx.Done():
 				return
-			default:
-				ipPkt, err := ip.Read()
-				if err != nil {
-					log.Printf("read error: %s", err.Error())
-				}
+			case ipPkt := <-tcp.incomingQueue:
 				tcpHeader, err := unmarshal(ipPkt.Packet.Buf[ipPkt.IpHeader.IHL*4 : ipPkt.Packet.N])
 				if err != nil {
 					log.Printf("unmarshal error: %s", err)
+					ipPkt.Packet.Release()
 					continue
 				}
+				if tcpHeader.Flags.SYN && !tcpHeader.Flags.ACK && !tcp.listening(tcpHeader.DstPort) {
+					ip.SendError(ipPkt, icmp.TYPE_DEST_UNREACHABLE, icmp.CODE_PORT_UNREACHABLE, 0)
+					ipPkt.Packet.Release()
+					continue
+				}
+
+				// Connections keep the packet, so it is copied out of the
+				// pooled buffer, which goes back to the pool.
+				buf := make([]byte, ipPkt.Packet.N)
+				copy(buf, ipPkt.Packet.Buf[:ipPkt.Packet.N])
+				ipPkt.Packet.Release()
 				tcpPacket := TcpPacket{
 					IpHeader:  ipPkt.IpHeader,
 					TcpHeader: tcpHeader,
-					Packet:    ipPkt.Packet,
+					Packet:    network.Packet{Buf: buf, N: ipPkt.Packet.N, Protocol: ipPkt.Packet.Protocol},
 				}
 
 				tcp.manager.recv(tcp, tcpPacket)
@@ -81,6 +136,20 @@ func (tcp *TcpPacketQueue) Close() {
 	tcp.cancel()
 }
 
+// Return the largest segment payload that can be sent without
+// fragmentation. With a device that segments TCP packets itself this is
+// larger than the MTU allows.
+func (tcp *TcpPacketQueue) mss() int {
+	size := network.MTU
+	if tcp.ip != nil {
+		size = tcp.ip.GSOMaxSize()
+	}
+	return size - internet.LENGTH - LENGTH
+}
+
+// Write sends data on the connection, split into segments of at most the
+// MSS. SYN is only set on the first segment, and FIN and PSH only on the
+// last.
 func (tcp *TcpPacketQueue) Write(conn Connection, flgs HeaderFlags, data []byte) {
 	pkt := conn.Pkt
 	tcpDataLen := int(pkt.Packet.N) - (int(pkt.IpHeader.IHL) * 4) - (int(pkt.TcpHeader.DataOff) * 4)
@@ -95,6 +164,42 @@ func (tcp *TcpPacketQueue) Write(conn Connection, flgs HeaderFlags, data []byte)
 
 	seqNum := conn.initialSeqNum + conn.incrementSeqNum
 
+	mss := tcp.mss()
+	for sent := 0; ; {
+		n := len(data) - sent
+		if n > mss {
+			n = mss
+		}
+		segFlgs := flgs
+		segSeqNum := seqNum + uint32(sent)
+		if sent > 0 {
+			segFlgs.SYN = false
+			if flgs.SYN {
+				// The SYN takes up a sequence number before the data.
+				segSeqNum++
+			}
+		}
+		if sent+n < len(data) {
+			segFlgs.FIN = false
+			segFlgs.PSH = false
+		}
+		tcp.outgoingQueue <- segment(pkt, segSeqNum, ackNum, segFlgs, data[sent:sent+n])
+		sent += n
+		if sent == len(data) {
+			break
+		}
+	}
+
+	incrementSeqNum := 0
+	if flgs.SYN || flgs.FIN {
+		incrementSeqNum += 1
+	}
+	incrementSeqNum += len(data)
+	tcp.manager.updateIncrementSeqNum(pkt, uint32(incrementSeqNum))
+}
+
+// Build a segment replying to pkt.
+func segment(pkt TcpPacket, seqNum, ackNum uint32, flgs HeaderFlags, data []byte) network.Packet {
 	writeIpHdr := internet.NewIp(pkt.IpHeader.DstIP, pkt.IpHeader.SrcIP, LENGTH+len(data))
 	writeTcpHdr := New(
 		pkt.TcpHeader.DstPort,
@@ -104,23 +209,11 @@ func (tcp *TcpPacketQueue) Write(conn Connection, flgs HeaderFlags, data []byte)
 		flgs,
 	)
 
-	ipHdr := writeIpHdr.Marshal()
-	tcpHdr := writeTcpHdr.Marshal(conn.Pkt.IpHeader, data)
-
-	writePkt := append(ipHdr, tcpHdr...)
-	writePkt = append(writePkt, data...)
-
-	incrementSeqNum := 0
-	if flgs.SYN || flgs.FIN {
-		incrementSeqNum += 1
-	}
-	incrementSeqNum += len(data)
-	tcp.manager.updateIncrementSeqNum(pkt, uint32(incrementSeqNum))
-
-	tcp.outgoingQueue <- network.Packet{
-		Buf: writePkt,
-		N:   uintptr(len(writePkt)),
-	}
+	buf := network.AllocBuffer(len(data))
+	copy(buf.Put(len(data)), data)
+	writeTcpHdr.MarshalTo(buf.Push(LENGTH), pkt.IpHeader, data)
+	writeIpHdr.MarshalTo(buf.Push(writeIpHdr.Len()))
+	return buf.Packet()
 }
 
 func (tcp *TcpPacketQueue) ReadAcceptConnection() (Connection, error) {
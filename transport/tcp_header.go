@@ -70,9 +70,18 @@ func New(srcPort, dstPort uint16, seqNum, ackNum uint32, flags HeaderFlags) *Hea
 
 // Return a byte slice of the packet.
 func (h *Header) Marshal(ipHdr *internet.Header, data []byte) []byte {
+	pkt := make([]byte, LENGTH)
+	h.MarshalTo(pkt, ipHdr, data)
+	return pkt
+}
+
+// Write the header into the first LENGTH bytes of pkt, for example the
+// headroom of a network.Buffer. The checksum covers data, which follows the
+// header on the wire.
+func (h *Header) MarshalTo(pkt []byte, ipHdr *internet.Header, data []byte) {
 	f := h.Flags.marshal()
 
-	pkt := make([]byte, 20)
+	pkt = pkt[:LENGTH]
 	binary.BigEndian.PutUint16(pkt[0:2], h.SrcPort)
 	binary.BigEndian.PutUint16(pkt[2:4], h.DstPort)
 	binary.BigEndian.PutUint32(pkt[4:8], h.SeqNum)
@@ -83,29 +92,27 @@ func (h *Header) Marshal(ipHdr *internet.Header, data []byte) []byte {
 	binary.BigEndian.PutUint16(pkt[16:18], h.Checksum)
 	binary.BigEndian.PutUint16(pkt[18:20], h.UrgentPtr)
 
-	h.setChecksum(ipHdr, append(pkt, data...))
+	h.setChecksum(ipHdr, pkt, data)
 	binary.BigEndian.PutUint16(pkt[16:18], h.Checksum)
-
-	return pkt
 }
 
-// Calculates the checksum of the packet and sets Header.
-func (h *Header) setChecksum(ipHeader *internet.Header, pkt []byte) {
-	pseudoHeader := make([]byte, 12)
+// Calculates the checksum of the header followed by data and sets Header.
+func (h *Header) setChecksum(ipHeader *internet.Header, hdr []byte, data []byte) {
+	var pseudoHeader [12]byte
 	copy(pseudoHeader[0:4], ipHeader.SrcIP[:])
 	copy(pseudoHeader[4:8], ipHeader.DstIP[:])
 	pseudoHeader[8] = 0
 	pseudoHeader[9] = PROTOCOL
-	binary.BigEndian.PutUint16(pseudoHeader[10:12], uint16(len(pkt)))
-
-	buf := append(pseudoHeader, pkt...)
-	if len(buf)%2 != 0 {
-		buf = append(buf, 0)
-	}
+	binary.BigEndian.PutUint16(pseudoHeader[10:12], uint16(len(hdr)+len(data)))
 
 	var checksum uint32
-	for i := 0; i < len(buf); i += 2 {
-		checksum += uint32(binary.BigEndian.Uint16(buf[i : i+2]))
+	for _, buf := range [][]byte{pseudoHeader[:], hdr, data} {
+		for i := 0; i+1 < len(buf); i += 2 {
+			checksum += uint32(binary.BigEndian.Uint16(buf[i : i+2]))
+		}
+		if len(buf)%2 != 0 {
+			checksum += uint32(buf[len(buf)-1]) << 8
+		}
 	}
 
 	for checksum > 0xffff {
@@ -0,0 +1,196 @@
+package transport
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kawa1214/tcp-ip-go/internet"
+	"github.com/kawa1214/tcp-ip-go/network"
+)
+
+var (
+	testClient = [4]byte{10, 0, 0, 1}
+	testServer = [4]byte{10, 0, 0, 2}
+)
+
+// Return the bytes of a segment from the client to the server.
+func testSegment(srcPort, dstPort uint16, seqNum, ackNum uint32, flgs HeaderFlags, data []byte) []byte {
+	ipHdr := internet.NewIp(testClient, testServer, LENGTH+len(data))
+	tcpHdr := New(srcPort, dstPort, seqNum, ackNum, flgs)
+	pkt := append(ipHdr.Marshal(), tcpHdr.Marshal(ipHdr, data)...)
+	return append(pkt, data...)
+}
+
+// Parse the IP and TCP headers of a segment.
+func parseSegment(t *testing.T, pkt network.Packet) TcpPacket {
+	t.Helper()
+	ipHdr, err := internet.Unmarshal(pkt.Buf[:pkt.N])
+	if err != nil {
+		t.Fatalf("internet.Unmarshal: %s", err)
+	}
+	tcpHdr, err := unmarshal(pkt.Buf[ipHdr.Len():pkt.N])
+	if err != nil {
+		t.Fatalf("unmarshal: %s", err)
+	}
+	return TcpPacket{IpHeader: ipHdr, TcpHeader: tcpHdr, Packet: pkt}
+}
+
+func TestWriteFlags(t *testing.T) {
+	const initialSeqNum = 1000
+	mss := network.MTU - internet.LENGTH - LENGTH
+
+	tests := []struct {
+		name    string
+		flgs    HeaderFlags
+		size    int
+		want    []HeaderFlags
+		wantSeq []uint32
+	}{
+		{
+			name:    "one segment",
+			flgs:    HeaderFlags{ACK: true, PSH: true, FIN: true},
+			size:    100,
+			want:    []HeaderFlags{{ACK: true, PSH: true, FIN: true}},
+			wantSeq: []uint32{0},
+		},
+		{
+			name:    "fin and psh on the last segment",
+			flgs:    HeaderFlags{ACK: true, PSH: true, FIN: true},
+			size:    2*mss + 1,
+			want:    []HeaderFlags{{ACK: true}, {ACK: true}, {ACK: true, PSH: true, FIN: true}},
+			wantSeq: []uint32{0, uint32(mss), uint32(2 * mss)},
+		},
+		{
+			name:    "syn on the first segment",
+			flgs:    HeaderFlags{SYN: true, ACK: true},
+			size:    mss + 1,
+			want:    []HeaderFlags{{SYN: true, ACK: true}, {ACK: true}},
+			wantSeq: []uint32{0, uint32(mss) + 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tcp := NewTcpPacketQueue()
+			syn := testSegment(1234, 80, 1, 0, HeaderFlags{SYN: true}, nil)
+			conn := Connection{
+				Pkt:           parseSegment(t, network.Packet{Buf: syn, N: uintptr(len(syn))}),
+				initialSeqNum: initialSeqNum,
+			}
+			tcp.Write(conn, tt.flgs, make([]byte, tt.size))
+
+			var got []HeaderFlags
+			var gotSeq []uint32
+			for len(tcp.outgoingQueue) > 0 {
+				seg := parseSegment(t, <-tcp.outgoingQueue)
+				got = append(got, seg.TcpHeader.Flags)
+				gotSeq = append(gotSeq, seg.TcpHeader.SeqNum-initialSeqNum)
+				seg.Packet.Release()
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("flags = %+v, want %+v", got, tt.want)
+			}
+			if !reflect.DeepEqual(gotSeq, tt.wantSeq) {
+				t.Errorf("relative sequence numbers = %v, want %v", gotSeq, tt.wantSeq)
+			}
+		})
+	}
+}
+
+// Run a server stack with a TcpPacketQueue and a client stack with a bare
+// IpPacketQueue on the two ends of a pipe. Segments the client receives
+// are delivered to the returned channel.
+func newTestStacks(t *testing.T) (*TcpPacketQueue, *internet.IpPacketQueue, chan internet.IpPacket) {
+	t.Helper()
+	serverDevice, clientDevice := network.NewPipe()
+
+	serverIp := internet.NewIpPacketQueue()
+	serverIp.AddAddress(testServer)
+	serverIp.ManageQueues(serverDevice)
+	tcp := NewTcpPacketQueue()
+	tcp.Listen(80)
+	tcp.ManageQueues(serverIp)
+
+	clientIp := internet.NewIpPacketQueue()
+	clientIp.AddAddress(testClient)
+	received := make(chan internet.IpPacket, QUEUE_SIZE)
+	clientIp.Handle(internet.TCP_PROTOCOL, func(pkt internet.IpPacket) { received <- pkt })
+	clientIp.ManageQueues(clientDevice)
+
+	t.Cleanup(func() {
+		tcp.Close()
+		serverIp.Close()
+		clientIp.Close()
+		serverDevice.Close()
+	})
+	return tcp, clientIp, received
+}
+
+func TestHandshake(t *testing.T) {
+	const clientSeqNum = 100
+	tcp, client, received := newTestStacks(t)
+
+	send := func(seqNum, ackNum uint32, flgs HeaderFlags, data []byte) {
+		t.Helper()
+		seg := testSegment(1234, 80, seqNum, ackNum, flgs, data)
+		if err := client.Write(network.Packet{Buf: seg, N: uintptr(len(seg))}); err != nil {
+			t.Fatalf("Write: %s", err)
+		}
+	}
+	// Wait for a segment from the server and check its flags and
+	// acknowledgement number.
+	expect := func(flgs HeaderFlags, ackNum uint32) TcpPacket {
+		t.Helper()
+		select {
+		case pkt := <-received:
+			// Copy the segment out of the pooled buffer.
+			buf := make([]byte, pkt.Packet.N)
+			copy(buf, pkt.Packet.Buf[:pkt.Packet.N])
+			pkt.Packet.Release()
+			seg := parseSegment(t, network.Packet{Buf: buf, N: uintptr(len(buf))})
+			if seg.IpHeader.SrcIP != testServer || seg.TcpHeader.SrcPort != 80 || seg.TcpHeader.DstPort != 1234 {
+				t.Errorf("segment from %v:%d to port %d, want from %v:80 to port 1234", seg.IpHeader.SrcIP, seg.TcpHeader.SrcPort, seg.TcpHeader.DstPort, testServer)
+			}
+			if seg.TcpHeader.Flags != flgs || seg.TcpHeader.AckNum != ackNum {
+				t.Fatalf("got %+v acknowledging %d, want %+v acknowledging %d", seg.TcpHeader.Flags, seg.TcpHeader.AckNum, flgs, ackNum)
+			}
+			return seg
+		case <-time.After(time.Second):
+			t.Fatalf("no segment from the server, want %+v", flgs)
+			return TcpPacket{}
+		}
+	}
+
+	send(clientSeqNum, 0, HeaderFlags{SYN: true}, nil)
+	synAck := expect(HeaderFlags{SYN: true, ACK: true}, clientSeqNum+1)
+	serverSeqNum := synAck.TcpHeader.SeqNum + 1
+
+	send(clientSeqNum+1, serverSeqNum, HeaderFlags{ACK: true}, nil)
+	request := []byte("GET / HTTP/1.1\r\n\r\n")
+	send(clientSeqNum+1, serverSeqNum, HeaderFlags{PSH: true, ACK: true}, request)
+	expect(HeaderFlags{ACK: true}, clientSeqNum+1+uint32(len(request)))
+
+	conn, err := tcp.ReadAcceptConnection()
+	if err != nil {
+		t.Fatalf("ReadAcceptConnection: %s", err)
+	}
+	if conn.SrcPort != 1234 || conn.DstPort != 80 || conn.State != StateEstablished {
+		t.Errorf("accepted %d -> %d in state %d, want 1234 -> 80 established", conn.SrcPort, conn.DstPort, conn.State)
+	}
+	data := conn.Pkt.Packet.Buf[int(conn.Pkt.IpHeader.IHL)*4+int(conn.Pkt.TcpHeader.DataOff)*4 : conn.Pkt.Packet.N]
+	if !bytes.Equal(data, request) {
+		t.Errorf("accepted connection holds %q, want %q", data, request)
+	}
+
+	response := []byte("HTTP/1.1 200 OK\r\n\r\n")
+	tcp.Write(conn, HeaderFlags{PSH: true, ACK: true}, response)
+	seg := expect(HeaderFlags{PSH: true, ACK: true}, clientSeqNum+1+uint32(len(request)))
+	if seg.TcpHeader.SeqNum != serverSeqNum {
+		t.Errorf("response sequence number = %d, want %d", seg.TcpHeader.SeqNum, serverSeqNum)
+	}
+	if got := seg.Packet.Buf[seg.IpHeader.Len()+LENGTH : seg.Packet.N]; !bytes.Equal(got, response) {
+		t.Errorf("response = %q, want %q", got, response)
+	}
+}